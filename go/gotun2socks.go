@@ -2,6 +2,7 @@ package gotun2socks
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
@@ -38,6 +39,21 @@ func (c Callbacks) GetUid(sourceIp string, sourcePort uint16, destIp string, des
 	return c.uidCallback.FindUid(sourceIp, int(sourcePort), destIp, int(destPort))
 }
 
+// JavaDnsCallback receives every query answered by the dns forwarder while the
+// dns log is on. answers is a comma separated list of addresses, altered is set
+// if the hosts table, a blocklist or SafeSearch answered instead of the upstream.
+type JavaDnsCallback interface {
+	OnDnsQuery(uid int, name string, qtype string, rcode string, answers string, altered bool)
+}
+
+type dnsCallback struct {
+	javaCallback JavaDnsCallback
+}
+
+func (c dnsCallback) OnDnsQuery(entry *tun2socks.DnsLogEntry) {
+	c.javaCallback.OnDnsQuery(entry.Uid, entry.Name, entry.Type, entry.Rcode, strings.Join(entry.Answers, ","), entry.Altered)
+}
+
 var tun2SocksInstance *tun2socks.Tun2Socks
 var defaultProxy = &tun2socks.ProxyServer{
 	ProxyType:  tun2socks.PROXY_TYPE_NONE,
@@ -57,6 +73,22 @@ var dnsIp6 net.IP
 var callback *Callbacks = nil
 var customDialer net.Dialer
 var proxyServerMap map[int]*tun2socks.ProxyServer
+var deferredDial = false
+var tunMtu = tun2socks.DEFAULT_MTU
+var rejectAction = tun2socks.REJECT_RESET
+var tcpRecvBuffer = 0
+var tcpSendBuffer = 0
+var router = tun2socks.NewRouter()
+var dnsForwarder = true
+var fakeIp = false
+var dnsUrl = ""
+var dnsThroughProxy = false
+var dnsServers []tun2socks.DnsUpstreamConfig
+var dnsServersThroughProxy = false
+var dnsStrategy = tun2socks.DNS_STRATEGY_FAILOVER
+var dnsPolicy = tun2socks.NewDnsPolicy()
+var dnsLog *tun2socks.DnsLog
+var javaDnsCallback JavaDnsCallback
 
 func SayHi() string {
 	return "hi from tun2http!"
@@ -86,6 +118,39 @@ func AddProxyServer(uid int, ipPort string, proxyType int, httpAuthHeader string
 	proxyServerMap[uid] = proxy
 }
 
+func ResetRoutingRules() {
+	router.Reset()
+}
+
+// AddNamedProxy registers a proxy routing rules can refer to by name
+func AddNamedProxy(name string, ipPort string, proxyType int, httpAuthHeader string, login string, password string) {
+	if len(ipPort) < 8 {
+		proxyType = tun2socks.PROXY_TYPE_NONE
+	}
+
+	router.SetProxy(name, &tun2socks.ProxyServer{
+		ProxyType:  proxyType,
+		IpAddress:  ipPort,
+		AuthHeader: httpAuthHeader,
+		Login:      login,
+		Password:   password,
+	})
+}
+
+// AddRoutingRule appends a rule, rules are evaluated in the order they were
+// added. List arguments are comma separated, empty lists match anything.
+// action is one of tun2socks.ROUTE_PROXY, ROUTE_DIRECT or ROUTE_REJECT,
+// protocol is 6 for tcp, 17 for udp or 0 for both.
+func AddRoutingRule(action int, proxyName string, domains string, keywords string, cidrs string, ports string, uids string, protocol int) bool {
+	rule, err := tun2socks.NewRoutingRule(action, proxyName, domains, keywords, cidrs, ports, uids, protocol)
+	if err != nil {
+		log.Printf("Invalid routing rule: %s", err)
+		return false
+	}
+	router.AddRule(rule)
+	return true
+}
+
 func SetDefaultProxy(ipPort string, proxyType int, httpAuthHeader string, login string, password string) {
 	if len(ipPort) < 8 {
 		proxyType = tun2socks.PROXY_TYPE_NONE
@@ -113,6 +178,10 @@ func SetUidCallback(javaCallback JavaUidCallback) {
 }
 
 func SetDnsServer(server string, port int, isV4 bool) {
+	if strings.Contains(server, "://") {
+		SetDnsServerUrl(server, false)
+		return
+	}
 	if len(server) == 0 {
 		if isV4 {
 			dnsIp4 = nil
@@ -138,6 +207,274 @@ func SetDnsServer(server string, port int, isV4 bool) {
 	}
 }
 
+// LoadHosts pins names to addresses from a hosts-format file ("10.1.2.3
+// intranet.corp *.test.corp"), answered for A and AAAA before any upstream.
+// Replaces the previous table, returns the number of names loaded, -1 on error.
+func LoadHosts(path string) int {
+	hosts := tun2socks.NewHostsTable()
+	count, err := hosts.LoadFile(path)
+	if err != nil {
+		log.Printf("Error loading hosts %s: %s", path, err)
+		return -1
+	}
+	dnsPolicy.SetHosts(hosts)
+	log.Printf("Hosts loaded, %d names", count)
+	return count
+}
+
+func ClearHosts() {
+	dnsPolicy.SetHosts(nil)
+}
+
+// SetMtu tells the engine the mtu the tun was built with, larger udp
+// responses are fragmented to fit and tcp segments sized from it, 1500 if
+// never called. Takes effect on the next Run
+func SetMtu(mtu int) {
+	tunMtu = mtu
+}
+
+// SetTcpBuffers sets the per connection receive window offered to apps and
+// how much data may be sent to them unacked, 0 keeps the 256 KiB default.
+// Applies to connections opened afterwards.
+func SetTcpBuffers(recvBytes int, sendBytes int) {
+	tcpRecvBuffer = recvBytes
+	tcpSendBuffer = sendBytes
+	if tun2SocksInstance != nil {
+		tun2SocksInstance.SetTcpBuffers(recvBytes, sendBytes)
+	}
+}
+
+// SetRejectAction picks how rejected flows and failed dials are refused:
+// 0 resets tcp and drops udp, 1 answers with ICMP port unreachable and
+// 2 with ICMP administratively prohibited, so apps fall back without waiting
+func SetRejectAction(action int) {
+	rejectAction = action
+	if tun2SocksInstance != nil {
+		tun2SocksInstance.SetRejectAction(action)
+	}
+}
+
+func SetDeferredDial(enabled bool) {
+	deferredDial = enabled
+	if tun2SocksInstance != nil {
+		tun2SocksInstance.SetDeferredDial(enabled)
+	}
+}
+
+// SetDnsForwarder enables the engine's own dns forwarder with cache, when off
+// queries are relayed as plain udp flows
+func SetDnsForwarder(enabled bool) {
+	dnsForwarder = enabled
+	if tun2SocksInstance != nil {
+		tun2SocksInstance.SetDnsForwarder(enabled)
+	}
+}
+
+// SetFakeIpMode answers A/AAAA queries with addresses from 198.18.0.0/15 and
+// fdfe:dcba:9876::/64 and sends the domain to the proxy for flows toward them.
+// Both ranges have to be routed into the tun.
+func SetFakeIpMode(enabled bool) {
+	fakeIp = enabled
+	if tun2SocksInstance != nil {
+		tun2SocksInstance.SetFakeIp(enabled)
+	}
+}
+
+// SetDnsServerUrl sets an encrypted dns upstream, https://host/dns-query or
+// tls://host[:port], reached through the default proxy if throughProxy is
+// set. An empty url goes back to SetDnsServer, a list from AddDnsServer
+// takes precedence
+func SetDnsServerUrl(url string, throughProxy bool) bool {
+	dnsUrl = url
+	dnsThroughProxy = throughProxy
+	if tun2SocksInstance != nil {
+		return applyDnsUpstreams()
+	}
+	return true
+}
+
+// ResetDnsServers empties the upstream list, queries go back to the url set by
+// SetDnsServerUrl or the servers set by SetDnsServer
+func ResetDnsServers() bool {
+	dnsServers = nil
+	if tun2SocksInstance != nil {
+		return applyDnsUpstreams()
+	}
+	return true
+}
+
+// AddDnsServer appends an upstream to the list used instead of a single
+// server: udp://ip[:port] or a bare ip, https://host/dns-query or
+// tls://host[:port]. timeoutMs 0 uses the default of 5 seconds.
+func AddDnsServer(url string, timeoutMs int) bool {
+	if err := tun2socks.CheckDnsUrl(url); err != nil {
+		log.Printf("Error adding dns server: %s", err)
+		return false
+	}
+	dnsServers = append(dnsServers, tun2socks.DnsUpstreamConfig{
+		Url:     url,
+		Timeout: time.Duration(timeoutMs) * time.Millisecond,
+	})
+	if tun2SocksInstance != nil {
+		return applyDnsUpstreams()
+	}
+	return true
+}
+
+// SetDnsStrategy picks how the upstream list is used:
+// tun2socks.DNS_STRATEGY_FAILOVER tries the servers in order,
+// DNS_STRATEGY_RACE asks all and takes the first answer,
+// DNS_STRATEGY_ROUND_ROBIN rotates. Encrypted servers of the list go through
+// the default proxy if throughProxy is set.
+func SetDnsStrategy(strategy int, throughProxy bool) bool {
+	dnsStrategy = strategy
+	dnsServersThroughProxy = throughProxy
+	if tun2SocksInstance != nil {
+		return applyDnsUpstreams()
+	}
+	return true
+}
+
+func dnsProxy(throughProxy bool) *tun2socks.ProxyServer {
+	if throughProxy {
+		return defaultProxy
+	}
+	return nil
+}
+
+func applyDnsUpstreams() bool {
+	var err error
+	if len(dnsServers) > 0 {
+		err = tun2SocksInstance.SetDnsUpstreams(dnsServers, dnsStrategy, dnsProxy(dnsServersThroughProxy))
+	} else {
+		err = tun2SocksInstance.SetDnsUrl(dnsUrl, dnsProxy(dnsThroughProxy))
+	}
+	if err != nil {
+		log.Printf("Error setting dns upstreams: %s", err)
+		return false
+	}
+	return true
+}
+
+// LoadBlocklist replaces the dns blocklist of an app (uid -1 for all apps) with
+// the domains of a hosts-format or plain domain file. Subdomains are blocked
+// too. action is tun2socks.BLOCK_NXDOMAIN, BLOCK_SINKHOLE or BLOCK_PAGE_IP,
+// blockIp is the block page address for the latter. Returns the number of
+// domains loaded, -1 on error.
+func LoadBlocklist(uid int, path string, action int, blockIp string) int {
+	list := tun2socks.NewBlocklist(action, blockIp)
+	count, err := list.LoadFile(path)
+	if err != nil {
+		log.Printf("Error loading blocklist %s: %s", path, err)
+		return -1
+	}
+	dnsPolicy.SetBlocklist(uid, list)
+	log.Printf("Blocklist for uid %d loaded, %d domains", uid, count)
+	return count
+}
+
+func RemoveBlocklist(uid int) {
+	dnsPolicy.SetBlocklist(uid, nil)
+}
+
+func ClearBlocklists() {
+	dnsPolicy.ClearBlocklists()
+}
+
+// SetSafeSearch makes an app (uid -1 for all apps) resolve Google, Bing,
+// DuckDuckGo and YouTube to their SafeSearch and restricted mode hosts.
+// Only applies while the dns forwarder is on.
+func SetSafeSearch(uid int, enabled bool) {
+	dnsPolicy.SetSafeSearch(uid, enabled)
+}
+
+func ClearSafeSearch() {
+	dnsPolicy.ClearSafeSearch()
+}
+
+// SetBlockDnsBypass rejects connections to well known DoH/DoT/DoQ resolvers
+// (tcp reset, icmp unreachable for udp) so apps fall back to the engine's
+// resolver. Only applies while the dns forwarder is on.
+func SetBlockDnsBypass(enabled bool) {
+	if enabled {
+		dnsPolicy.SetBypassList(tun2socks.DefaultDnsBypassList())
+	} else {
+		dnsPolicy.SetBypassList(nil)
+	}
+}
+
+// LoadDnsBypassList replaces the rejected resolvers with the addresses and host
+// names of a file, one per line, optionally on top of the built-in ones.
+// Returns the number of entries loaded, -1 on error.
+func LoadDnsBypassList(path string, withDefaults bool) int {
+	list := tun2socks.NewDnsBypassList()
+	if withDefaults {
+		list = tun2socks.DefaultDnsBypassList()
+	}
+	count, err := list.LoadFile(path)
+	if err != nil {
+		log.Printf("Error loading dns bypass list %s: %s", path, err)
+		return -1
+	}
+	dnsPolicy.SetBypassList(list)
+	log.Printf("Dns bypass list loaded, %d entries", count)
+	return count
+}
+
+// SetDnsLog keeps the last size queries answered by the dns forwarder, 0 turns
+// the log off
+func SetDnsLog(size int) {
+	if size > 0 {
+		dnsLog = tun2socks.NewDnsLog(size)
+		if javaDnsCallback != nil {
+			dnsLog.SetCallback(dnsCallback{javaCallback: javaDnsCallback})
+		}
+	} else {
+		dnsLog = nil
+	}
+	if tun2SocksInstance != nil {
+		tun2SocksInstance.SetDnsLog(dnsLog)
+	}
+}
+
+// SetDnsCallback delivers each logged query to the app, nil removes it. Calls
+// come from engine goroutines and should return quickly.
+func SetDnsCallback(javaCallback JavaDnsCallback) {
+	javaDnsCallback = javaCallback
+	if dnsLog == nil {
+		return
+	}
+	if javaCallback != nil {
+		dnsLog.SetCallback(dnsCallback{javaCallback: javaCallback})
+	} else {
+		dnsLog.SetCallback(nil)
+	}
+}
+
+// GetDnsLog returns the logged queries newer than seq as a json array, oldest
+// first. Pass the seq of the last entry read to poll for new ones.
+func GetDnsLog(since int64) string {
+	if dnsLog == nil {
+		return "[]"
+	}
+	entries := dnsLog.Entries(since)
+	if entries == nil {
+		return "[]"
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		log.Printf("Error encoding dns log: %s", err)
+		return "[]"
+	}
+	return string(data)
+}
+
+func ClearDnsLog() {
+	if dnsLog != nil {
+		dnsLog.Clear()
+	}
+}
+
 func SetMaxCpus(maxCpus int) {
 	log.Printf("Setting max cpus to %d", maxCpus)
 	runtime.GOMAXPROCS(maxCpus)
@@ -155,10 +492,19 @@ func Run(descriptor int, maxCpus int, logPath string, appVersion string) {
 	var tunGW string = "10.0.0.1"
 
 	f := tun.NewTunDev(uintptr(descriptor), "tun0", tunAddr, tunGW)
-	tun2SocksInstance = tun2socks.New(f, dnsIp4, dnsIp6, dnsPort)
+	tun2SocksInstance = tun2socks.New(f, tunMtu, dnsIp4, dnsIp6, dnsPort)
 
 	tun2SocksInstance.SetDefaultProxy(defaultProxy)
 	tun2SocksInstance.SetProxyServers(proxyServerMap)
+	tun2SocksInstance.SetRejectAction(rejectAction)
+	tun2SocksInstance.SetTcpBuffers(tcpRecvBuffer, tcpSendBuffer)
+	tun2SocksInstance.SetDeferredDial(deferredDial)
+	tun2SocksInstance.SetRouter(router)
+	tun2SocksInstance.SetDnsForwarder(dnsForwarder)
+	tun2SocksInstance.SetFakeIp(fakeIp)
+	tun2SocksInstance.SetDnsPolicy(dnsPolicy)
+	tun2SocksInstance.SetDnsLog(dnsLog)
+	applyDnsUpstreams()
 	if callback != nil && callback.uidCallback != nil {
 		tun2SocksInstance.SetUidCallback(callback)
 	} else {
@@ -333,13 +333,13 @@ func ParseUDPRequest(data []byte) (udpReq *UDPRequest, err error) {
 	pos := 4
 	r := bytes.NewReader(data[pos:])
 	host, e := readSocksHost(r, udpReq.HostType)
-	if err != nil {
+	if e != nil {
 		err = fmt.Errorf("Invalid UDP Request: fail to read dst host: %s", e)
 		return
 	}
 	udpReq.DstHost = host
 	port, e := readSocksPort(r)
-	if err != nil {
+	if e != nil {
 		err = fmt.Errorf("Invalid UDP Request: fail to read dst port: %s", e)
 		return
 	}
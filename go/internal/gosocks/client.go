@@ -198,3 +198,38 @@ func ClientRequest(conn *SocksConn, req *SocksRequest) (reply *SocksReply, err e
 	reply, err = ReadSocksReply(conn)
 	return
 }
+
+// ClientUDPAssociate asks the server for a UDP relay on an already
+// authenticated connection and returns the relay address. The association
+// lives as long as conn stays open.
+func ClientUDPAssociate(conn *SocksConn) (relay *net.UDPAddr, err error) {
+	req := &SocksRequest{SocksCmdUDPAssociate, SocksIPv4Host, "0.0.0.0", 0}
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		req.HostType = SocksIPv6Host
+		req.DstHost = "::"
+	}
+
+	reply, err := ClientRequest(conn, req)
+	if err != nil {
+		return
+	}
+	if reply.Rep != SocksSucceeded {
+		err = fmt.Errorf("UDP associate rejected, retcode: %d", reply.Rep)
+		return
+	}
+
+	addr := SocksAddrToNetAddr("udp", reply.BndHost, reply.BndPort)
+	if addr == nil {
+		err = fmt.Errorf("Invalid UDP relay address %s:%d", reply.BndHost, reply.BndPort)
+		return
+	}
+	relay = addr.(*net.UDPAddr)
+	if relay.IP.IsUnspecified() {
+		// relay listens on all interfaces of the proxy host
+		if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = remote.IP
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return
+}
@@ -97,7 +97,7 @@ func findStringInData(data []byte, stringToFind string, startIndex int) int {
 	stringLen := len(stringToFind)
 	dataLen := len(data)
 
-	for i := startIndex; i < dataLen-stringLen; i++ {
+	for i := startIndex; i <= dataLen-stringLen; i++ {
 		found := true
 		for j := 0; j < stringLen; j++ {
 			if data[i+j] != stringToFind[j] {
@@ -0,0 +1,109 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+const (
+	ICMPv4TypeEchoReply       uint8 = 0
+	ICMPv4TypeDestUnreachable uint8 = 3
+	ICMPv4TypeEchoRequest     uint8 = 8
+
+	ICMPv4CodeHostUnreachable uint8 = 1
+	ICMPv4CodePortUnreachable uint8 = 3
+	ICMPv4CodeAdminProhibited uint8 = 13
+
+	ICMPv6TypeDestUnreachable uint8 = 1
+	ICMPv6TypeEchoRequest     uint8 = 128
+	ICMPv6TypeEchoReply       uint8 = 129
+
+	ICMPv6CodeAdminProhibited uint8 = 1
+	ICMPv6CodeAddrUnreachable uint8 = 3
+	ICMPv6CodePortUnreachable uint8 = 4
+
+	ICMP_HEADER_LENGTH int = 8
+	// error messages quote as much of the offending packet as fits in the
+	// minimum datagram size of the family
+	ICMPv4_MAX_ERROR_QUOTE int = 576 - 20 - ICMP_HEADER_LENGTH
+	ICMPv6_MAX_ERROR_QUOTE int = 1280 - 40 - ICMP_HEADER_LENGTH
+)
+
+// ICMP covers ICMPv4 and ICMPv6 messages, Rest is the type specific second
+// word (id and sequence for echo messages, unused for errors)
+type ICMP struct {
+	Type     uint8
+	Code     uint8
+	Checksum uint16
+	Rest     [4]byte
+	Payload  []byte
+}
+
+var (
+	icmpPool *sync.Pool = &sync.Pool{
+		New: func() interface{} {
+			return &ICMP{}
+		},
+	}
+)
+
+func NewICMP() *ICMP {
+	var zero ICMP
+	icmp := icmpPool.Get().(*ICMP)
+	*icmp = zero
+	return icmp
+}
+
+func ReleaseICMP(icmp *ICMP) {
+	// clear internal slice references
+	icmp.Payload = nil
+	icmpPool.Put(icmp)
+}
+
+func ParseICMP(pkt []byte, icmp *ICMP) error {
+	if len(pkt) < ICMP_HEADER_LENGTH {
+		return fmt.Errorf("payload too small for ICMP: %d bytes", len(pkt))
+	}
+
+	icmp.Type = pkt[0]
+	icmp.Code = pkt[1]
+	icmp.Checksum = binary.BigEndian.Uint16(pkt[2:4])
+	copy(icmp.Rest[:], pkt[4:8])
+	if len(pkt) > ICMP_HEADER_LENGTH {
+		icmp.Payload = pkt[ICMP_HEADER_LENGTH:]
+	} else {
+		icmp.Payload = nil
+	}
+
+	return nil
+}
+
+func (icmp *ICMP) Id() uint16 {
+	return binary.BigEndian.Uint16(icmp.Rest[0:2])
+}
+
+func (icmp *ICMP) Seq() uint16 {
+	return binary.BigEndian.Uint16(icmp.Rest[2:4])
+}
+
+func (icmp *ICMP) SetIdSeq(id uint16, seq uint16) {
+	binary.BigEndian.PutUint16(icmp.Rest[0:2], id)
+	binary.BigEndian.PutUint16(icmp.Rest[2:4], seq)
+}
+
+// Serialize writes the header, ckFields are the checksummed data: header and
+// payload for ICMPv4, preceded by the pseudo header for ICMPv6
+func (icmp *ICMP) Serialize(hdr []byte, ckFields ...[]byte) error {
+	if len(hdr) != ICMP_HEADER_LENGTH {
+		return fmt.Errorf("incorrect buffer size: %d buffer given, %d needed", len(hdr), ICMP_HEADER_LENGTH)
+	}
+	hdr[0] = icmp.Type
+	hdr[1] = icmp.Code
+	hdr[2] = 0
+	hdr[3] = 0
+	copy(hdr[4:], icmp.Rest[:])
+	icmp.Checksum = Checksum(ckFields...)
+	binary.BigEndian.PutUint16(hdr[2:], icmp.Checksum)
+	return nil
+}
@@ -151,13 +151,16 @@ func (ip *Ip) SetNextProto(proto IPProtocol) {
 		ip.V4.Protocol = proto
 	} else {
 		ip.V6.NextHeader = proto
+		ip.V6.Protocol = proto
 	}
 }
 
+// GetNextProto returns the transport protocol, for IPv6 the one after the
+// extension headers
 func (ip *Ip) GetNextProto() IPProtocol {
 	if ip.Version == 4 {
 		return ip.V4.Protocol
 	} else {
-		return ip.V6.NextHeader
+		return ip.V6.Protocol
 	}
 }
@@ -4,6 +4,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"sync"
+	"sync/atomic"
+)
+
+const (
+	IPv6_FRAGMENT_LENGTH = 8
 )
 
 type IPv6 struct {
@@ -12,6 +17,25 @@ type IPv6 struct {
 	PayloadLen   uint16
 	NextHeader   IPProtocol
 	HopLimit     uint8
+
+	// upper layer protocol after the extension headers
+	Protocol IPProtocol
+	// set if the packet carries a Fragment header
+	Fragment *IPv6Fragment
+}
+
+// IPv6Fragment is the Fragment extension header of a packet
+type IPv6Fragment struct {
+	NextHeader IPProtocol
+	Offset     int // in bytes
+	More       bool
+	Id         uint32
+	// position of the Fragment header in the packet, everything before it is
+	// the unfragmentable part
+	HeaderStart int
+
+	// position of the next header field pointing to the Fragment header
+	nextHeaderPos int
 }
 
 var (
@@ -21,9 +45,17 @@ var (
 		},
 	}
 	HeaderLen = 40 // header length
+
+	globalIPv6FragId uint32
 )
 
+// IPv6FragmentId returns the identification for the next fragmented datagram
+func IPv6FragmentId() uint32 {
+	return atomic.AddUint32(&globalIPv6FragId, 1)
+}
+
 func releaseIPv6(ip6 *IPv6) {
+	ip6.Fragment = nil
 	ipv6Pool.Put(ip6)
 }
 
@@ -48,8 +80,86 @@ func parseIPv6(pkt []byte, ip *Ip) error {
 	ip.Src = pkt[8:24]
 	ip.Dst = pkt[24:40]
 
-	ip.Payload = pkt[40:]
+	end := len(pkt)
+	if ip.V6.PayloadLen != 0 && HeaderLen+int(ip.V6.PayloadLen) < end {
+		end = HeaderLen + int(ip.V6.PayloadLen)
+	}
+
+	// walk the extension headers to the upper layer protocol
+	next := ip.V6.NextHeader
+	nextPos := 6
+	off := HeaderLen
+	for {
+		var extLen int
+		switch next {
+		case IPProtocolIPv6HopByHop, IPProtocolIPv6Routing, IPProtocolIPv6Destination:
+			if off+8 > end {
+				return fmt.Errorf("IPv6 extension header truncated")
+			}
+			extLen = (int(pkt[off+1]) + 1) * 8
+		case IPProtocolAH:
+			if off+8 > end {
+				return fmt.Errorf("IPv6 authentication header truncated")
+			}
+			extLen = (int(pkt[off+1]) + 2) * 4
+		case IPProtocolIPv6Fragment:
+			if off+8 > end {
+				return fmt.Errorf("IPv6 fragment header truncated")
+			}
+			offsetFlags := binary.BigEndian.Uint16(pkt[off+2 : off+4])
+			ip.V6.Fragment = &IPv6Fragment{
+				NextHeader:    IPProtocol(pkt[off]),
+				Offset:        int(offsetFlags>>3) * 8,
+				More:          offsetFlags&0x1 != 0,
+				Id:            binary.BigEndian.Uint32(pkt[off+4 : off+8]),
+				HeaderStart:   off,
+				nextHeaderPos: nextPos,
+			}
+			extLen = 8
+		default:
+			ip.V6.Protocol = next
+			ip.Payload = pkt[off:end]
+			return nil
+		}
+		if off+extLen > end {
+			return fmt.Errorf("IPv6 extension header exceeds packet, type %d length %d", next, extLen)
+		}
+
+		next = IPProtocol(pkt[off])
+		nextPos = off
+		off += extLen
+		if ip.V6.Fragment != nil && ip.V6.Fragment.Offset != 0 {
+			// later fragments carry no headers, just data
+			ip.V6.Protocol = next
+			ip.Payload = pkt[off:end]
+			return nil
+		}
+	}
+}
 
+// Unfragmentable returns a copy of the headers before the Fragment header
+// with its next header field pointing past the Fragment header, the start of
+// the reassembled packet
+func (f *IPv6Fragment) Unfragmentable(pkt []byte) []byte {
+	ret := make([]byte, f.HeaderStart)
+	copy(ret, pkt[:f.HeaderStart])
+	ret[f.nextHeaderPos] = byte(f.NextHeader)
+	return ret
+}
+
+// Serialize writes the Fragment header, Offset must be a multiple of 8
+func (f *IPv6Fragment) Serialize(hdr []byte) error {
+	if len(hdr) != IPv6_FRAGMENT_LENGTH {
+		return fmt.Errorf("incorrect buffer size: %d buffer given, %d needed", len(hdr), IPv6_FRAGMENT_LENGTH)
+	}
+	offsetFlags := uint16(f.Offset/8) << 3
+	if f.More {
+		offsetFlags |= 0x1
+	}
+	hdr[0] = byte(f.NextHeader)
+	hdr[1] = 0
+	binary.BigEndian.PutUint16(hdr[2:], offsetFlags)
+	binary.BigEndian.PutUint32(hdr[4:], f.Id)
 	return nil
 }
 
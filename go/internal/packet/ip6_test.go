@@ -0,0 +1,86 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// ipv6Packet builds a packet from fd00::1 to fd00::2 whose headers chain
+// through exts, each an 8 byte extension header of the given type, to proto
+func ipv6Packet(exts []IPProtocol, proto IPProtocol, fragment *IPv6Fragment, payload []byte) []byte {
+	pkt := make([]byte, HeaderLen)
+	pkt[0] = 6 << 4
+	pkt[7] = 64
+	pkt[23] = 1
+	pkt[39] = 2
+	pkt[8], pkt[24] = 0xfd, 0xfd
+
+	nextPos := 6
+	for _, ext := range exts {
+		pkt[nextPos] = byte(ext)
+		nextPos = len(pkt)
+		hdr := make([]byte, 8)
+		if ext == IPProtocolIPv6Fragment {
+			fragment.Serialize(hdr)
+		}
+		pkt = append(pkt, hdr...)
+	}
+	pkt[nextPos] = byte(proto)
+	pkt = append(pkt, payload...)
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-HeaderLen))
+	return pkt
+}
+
+func TestParseIPv6ExtensionHeaders(t *testing.T) {
+	payload := []byte("0123456789abcdef")
+	pkt := ipv6Packet([]IPProtocol{IPProtocolIPv6HopByHop, IPProtocolIPv6Routing, IPProtocolIPv6Destination}, IPProtocolTCP, nil, payload)
+	ip := &Ip{}
+	if e := ParseIp(pkt, ip); e != nil {
+		t.Fatal(e)
+	}
+	if ip.GetNextProto() != IPProtocolTCP || ip.V6.Fragment != nil || !bytes.Equal(ip.Payload, payload) {
+		t.Errorf("protocol %d fragment %v payload %q", ip.GetNextProto(), ip.V6.Fragment, ip.Payload)
+	}
+}
+
+func TestParseIPv6Fragment(t *testing.T) {
+	payload := []byte("0123456789abcdef")
+	exts := []IPProtocol{IPProtocolIPv6HopByHop, IPProtocolIPv6Routing, IPProtocolIPv6Destination, IPProtocolIPv6Fragment}
+
+	first := ipv6Packet(exts, IPProtocolUDP, &IPv6Fragment{NextHeader: IPProtocolUDP, More: true, Id: 7}, payload)
+	ip := &Ip{}
+	if e := ParseIp(first, ip); e != nil {
+		t.Fatal(e)
+	}
+	frag := ip.V6.Fragment
+	if frag == nil || frag.Offset != 0 || !frag.More || frag.Id != 7 || frag.HeaderStart != HeaderLen+24 {
+		t.Fatalf("fragment %+v", frag)
+	}
+	if ip.GetNextProto() != IPProtocolUDP || !bytes.Equal(ip.Payload, payload) {
+		t.Errorf("protocol %d payload %q", ip.GetNextProto(), ip.Payload)
+	}
+	// the destination options header now points past the Fragment header
+	unfragmentable := frag.Unfragmentable(first)
+	if len(unfragmentable) != frag.HeaderStart || unfragmentable[HeaderLen+16] != byte(IPProtocolUDP) {
+		t.Errorf("unfragmentable part %v", unfragmentable)
+	}
+
+	// later fragments carry data right after the Fragment header
+	later := ipv6Packet(exts, IPProtocolUDP, &IPv6Fragment{NextHeader: IPProtocolUDP, Offset: 16, Id: 7}, payload)
+	if e := ParseIp(later, ip); e != nil {
+		t.Fatal(e)
+	}
+	if ip.V6.Fragment.Offset != 16 || ip.V6.Fragment.More || !bytes.Equal(ip.Payload, payload) {
+		t.Errorf("fragment %+v payload %q", ip.V6.Fragment, ip.Payload)
+	}
+}
+
+func TestParseIPv6Truncated(t *testing.T) {
+	pkt := ipv6Packet([]IPProtocol{IPProtocolIPv6HopByHop}, IPProtocolTCP, nil, nil)
+	// the hop-by-hop header claims 16 bytes
+	pkt[HeaderLen+1] = 1
+	if e := ParseIp(pkt, &Ip{}); e == nil {
+		t.Error("extension header past the packet accepted")
+	}
+}
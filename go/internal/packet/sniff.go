@@ -0,0 +1,65 @@
+package packet
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+var httpMethods = []string{"GET ", "POST ", "PUT ", "DELETE ", "HEAD ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// SniffHostname looks for a TLS SNI or an HTTP Host header in the first bytes
+// a client sent on a stream. complete is true when the hostname was found or
+// when more data can't change the result, e.g. the stream is neither TLS nor
+// HTTP or the whole ClientHello / request header has already been seen.
+func SniffHostname(data []byte) (hostname string, complete bool) {
+	if len(data) == 0 {
+		return "", false
+	}
+
+	if data[0] == 0x16 {
+		hostname, err := GetHostnameTls(data)
+		if err == nil {
+			return hostname, true
+		}
+		if len(data) < TLSHeaderLength {
+			return "", false
+		}
+		recordLength := int(binary.BigEndian.Uint16(data[3:5]))
+		return "", len(data) >= TLSHeaderLength+recordLength
+	}
+
+	if !looksLikeHttp(data) {
+		return "", true
+	}
+	hostname, err := GetHostnamePlainHttp(data)
+	if err == nil {
+		return stripPort(hostname), true
+	}
+	return "", findStringInData(data, "\r\n\r\n", 0) >= 0
+}
+
+func looksLikeHttp(data []byte) bool {
+	for _, method := range httpMethods {
+		n := len(method)
+		if len(data) < n {
+			n = len(data)
+		}
+		if string(data[:n]) == method[:n] {
+			return true
+		}
+	}
+	return false
+}
+
+func stripPort(host string) string {
+	if strings.HasPrefix(host, "[") {
+		if end := strings.Index(host, "]"); end > 0 {
+			return host[1:end]
+		}
+		return host
+	}
+	if strings.Count(host, ":") == 1 {
+		return host[:strings.Index(host, ":")]
+	}
+	return host
+}
@@ -7,6 +7,15 @@ import (
 	"sync"
 )
 
+const (
+	TCPOptionKindEndList       uint8 = 0
+	TCPOptionKindNop           uint8 = 1
+	TCPOptionKindMSS           uint8 = 2
+	TCPOptionKindWindowScale   uint8 = 3
+	TCPOptionKindSACKPermitted uint8 = 4
+	TCPOptionKindSACK          uint8 = 5
+)
+
 type TCPOption struct {
 	OptionType   uint8
 	OptionLength uint8
@@ -150,7 +159,7 @@ func (tcp *TCP) HeaderLength() int {
 				optionLength += 2 + len(o.OptionData)
 			}
 		}
-		tcp.Padding = lotsOfZeros[:optionLength%4]
+		tcp.Padding = lotsOfZeros[:(4-optionLength%4)%4]
 		tcp.headerLength = len(tcp.Padding) + optionLength + 20
 		tcp.DataOffset = uint8(tcp.headerLength / 4)
 	}
@@ -158,6 +167,16 @@ func (tcp *TCP) HeaderLength() int {
 	return tcp.headerLength
 }
 
+// FindOption returns the first option of a kind
+func (tcp *TCP) FindOption(kind uint8) (TCPOption, bool) {
+	for _, o := range tcp.Options {
+		if o.OptionType == kind {
+			return o, true
+		}
+	}
+	return TCPOption{}, false
+}
+
 func (tcp *TCP) flagsAndOffset() uint16 {
 	f := uint16(tcp.DataOffset) << 12
 	if tcp.FIN {
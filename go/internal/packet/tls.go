@@ -53,11 +53,17 @@ func GetSNIBlock(data []byte) ([]byte, error) {
 		if index >= len(data)-2 {
 			break
 		}
-		length := int((data[index] << 8) + data[index+1])
+		length := int(data[index])<<8 + int(data[index+1])
 		endIndex := index + 2 + length
 		if data[index+2] == 0x00 { /* SNI */
 			sni := data[index+3:]
-			sniLength := int((sni[0] << 8) + sni[1])
+			if len(sni) < 2 {
+				break
+			}
+			sniLength := int(sni[0])<<8 + int(sni[1])
+			if sniLength+2 > len(sni) {
+				break
+			}
 			return sni[2 : sniLength+2], nil
 		}
 		index = endIndex
@@ -75,7 +81,7 @@ func GetSNBlock(data []byte) ([]byte, error) {
 		return []byte{}, fmt.Errorf("Not enough bytes to be an SN block")
 	}
 
-	extensionLength := int((data[index] << 8) + data[index+1])
+	extensionLength := int(data[index])<<8 + int(data[index+1])
 	if extensionLength+2 > len(data) {
 		return []byte{}, fmt.Errorf("Extension looks bonkers")
 	}
@@ -85,8 +91,11 @@ func GetSNBlock(data []byte) ([]byte, error) {
 		if index+3 >= len(data) {
 			break
 		}
-		length := int((data[index+2] << 8) + data[index+3])
+		length := int(data[index+2])<<8 + int(data[index+3])
 		endIndex := index + 4 + length
+		if endIndex > len(data) {
+			break
+		}
 		if data[index] == 0x00 && data[index+1] == 0x00 {
 			return data[index+4 : endIndex], nil
 		}
@@ -121,7 +130,7 @@ func GetExtensionBlock(data []byte) ([]byte, error) {
 	}
 
 	/* Index is at Cipher List Length bits */
-	if newIndex := (index + 2 + int((data[index]<<8)+data[index+1])); (newIndex + 1) < len(data) {
+	if newIndex := (index + 2 + int(data[index])<<8 + int(data[index+1])); (newIndex + 1) < len(data) {
 		index = newIndex
 	} else {
 		return []byte{}, fmt.Errorf("Not enough bytes for the Cipher List")
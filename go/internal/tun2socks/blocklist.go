@@ -0,0 +1,125 @@
+package tun2socks
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	BLOCK_NXDOMAIN = 0
+	BLOCK_SINKHOLE = 1
+	BLOCK_PAGE_IP  = 2
+
+	BLOCK_TTL = 60
+)
+
+// Blocklist is a set of blocked domains, subdomains included, and the answer
+// given for them
+type Blocklist struct {
+	trie     *domainTrie
+	Action   int
+	BlockIp4 net.IP
+	BlockIp6 net.IP
+}
+
+// NewBlocklist creates an empty list, blockIp is the block page address for
+// BLOCK_PAGE_IP and may be of either family
+func NewBlocklist(action int, blockIp string) *Blocklist {
+	list := &Blocklist{
+		trie:   newDomainTrie(),
+		Action: action,
+	}
+	if ip := net.ParseIP(blockIp); ip != nil {
+		if ip.To4() != nil {
+			list.BlockIp4 = ip.To4()
+		} else {
+			list.BlockIp6 = ip
+		}
+	}
+	return list
+}
+
+func (list *Blocklist) Add(domain string) {
+	list.trie.add(domain)
+}
+
+func (list *Blocklist) Contains(domain string) bool {
+	return list.trie.match(domain)
+}
+
+// Load reads a hosts file ("0.0.0.0 ads.example.com") or a plain list with
+// one domain per line, returns the number of domains added
+func (list *Blocklist) Load(r io.Reader) (int, error) {
+	count := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			// hosts format, address followed by names
+			fields = fields[1:]
+		}
+		for _, domain := range fields {
+			switch normalizeDomain(domain) {
+			case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback":
+				continue
+			}
+			list.Add(domain)
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+func (list *Blocklist) LoadFile(path string) (int, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return 0, e
+	}
+	defer f.Close()
+	return list.Load(f)
+}
+
+// answer synthesizes the response for a blocked query
+func (list *Blocklist) answer(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	if list.Action == BLOCK_NXDOMAIN {
+		resp.SetRcode(req, dns.RcodeNameError)
+		resp.RecursionAvailable = true
+		return resp
+	}
+
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	question := req.Question[0]
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: BLOCK_TTL}
+	switch question.Qtype {
+	case dns.TypeA:
+		ip := net.IPv4zero.To4()
+		if list.Action == BLOCK_PAGE_IP && list.BlockIp4 != nil {
+			ip = list.BlockIp4
+		}
+		resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip})
+	case dns.TypeAAAA:
+		ip := net.IPv6unspecified
+		if list.Action == BLOCK_PAGE_IP {
+			// no v6 block page, answer empty so the client uses the v4 one
+			ip = list.BlockIp6
+		}
+		if ip != nil {
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return resp
+}
@@ -0,0 +1,147 @@
+package tun2socks
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+var (
+	// well known public resolvers offering DNS-over-HTTPS, DNS-over-TLS or
+	// DNS-over-QUIC
+	defaultDnsBypassIps = []string{
+		"1.1.1.1", "1.0.0.1", "1.1.1.2", "1.0.0.2", "1.1.1.3", "1.0.0.3",
+		"2606:4700:4700::1111", "2606:4700:4700::1001",
+		"8.8.8.8", "8.8.4.4", "2001:4860:4860::8888", "2001:4860:4860::8844",
+		"9.9.9.9", "149.112.112.112", "9.9.9.11", "149.112.112.11", "2620:fe::fe", "2620:fe::9",
+		"208.67.222.222", "208.67.220.220", "2620:119:35::35", "2620:119:53::53",
+		"94.140.14.14", "94.140.15.15", "2a10:50c0::ad1:ff", "2a10:50c0::ad2:ff",
+		"185.228.168.168", "185.228.169.168",
+		"45.90.28.0", "45.90.30.0",
+		"76.76.2.0", "76.76.10.0",
+		"194.242.2.2",
+	}
+	defaultDnsBypassHosts = []string{
+		"dns.google", "dns.google.com", "8888.google",
+		"cloudflare-dns.com", "one.one.one.one", "1dot1dot1dot1.cloudflare-dns.com",
+		"dns.quad9.net",
+		"doh.opendns.com", "dns.opendns.com",
+		"dns.adguard.com", "dns.adguard-dns.com",
+		"dns.nextdns.io",
+		"doh.cleanbrowsing.org",
+		"freedns.controld.com",
+		"dns.mullvad.net",
+		"doh.dns.sb",
+	}
+)
+
+// DnsBypassList recognises encrypted dns resolvers apps could use to get
+// around the engine's resolver, by address and by TLS server name
+type DnsBypassList struct {
+	ips   map[string]bool
+	hosts *domainTrie
+}
+
+func NewDnsBypassList() *DnsBypassList {
+	return &DnsBypassList{
+		ips:   make(map[string]bool),
+		hosts: newDomainTrie(),
+	}
+}
+
+// DefaultDnsBypassList returns a list of the well known public resolvers
+func DefaultDnsBypassList() *DnsBypassList {
+	list := NewDnsBypassList()
+	for _, ip := range defaultDnsBypassIps {
+		list.AddIp(ip)
+	}
+	for _, host := range defaultDnsBypassHosts {
+		list.AddHost(host)
+	}
+	return list
+}
+
+func (list *DnsBypassList) AddIp(ip string) bool {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return false
+	}
+	list.ips[parsed.String()] = true
+	return true
+}
+
+// AddHost blocks a resolver host name and its subdomains
+func (list *DnsBypassList) AddHost(host string) {
+	list.hosts.add(host)
+}
+
+func (list *DnsBypassList) ContainsIp(ip net.IP) bool {
+	return list.ips[ip.String()]
+}
+
+func (list *DnsBypassList) ContainsHost(host string) bool {
+	return list.hosts.match(host)
+}
+
+// Load reads one address or host name per line, returns the number of
+// entries added
+func (list *DnsBypassList) Load(r io.Reader) (int, error) {
+	count := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		for _, entry := range strings.Fields(line) {
+			if !list.AddIp(entry) {
+				list.AddHost(entry)
+			}
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+func (list *DnsBypassList) LoadFile(path string) (int, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return 0, e
+	}
+	defer f.Close()
+	return list.Load(f)
+}
+
+// dnsBypassPort reports whether flows to dstPort are checked by dnsBypass
+func (t2s *Tun2Socks) dnsBypassPort(dstPort uint16) bool {
+	if !t2s.dnsEnabled || t2s.dnsPolicy == nil || t2s.dnsPolicy.bypassList() == nil {
+		return false
+	}
+	return dstPort == 443 || dstPort == 853
+}
+
+// dnsBypass reports whether a flow goes to a known encrypted dns resolver
+// while the engine filters dns. Only the DoH/DoT/DoQ ports are checked so
+// other services sharing a resolver address keep working.
+func (t2s *Tun2Socks) dnsBypass(dstIP net.IP, dstPort uint16, hostname string) bool {
+	if !t2s.dnsBypassPort(dstPort) {
+		return false
+	}
+	// the list may have been removed meanwhile
+	list := t2s.dnsPolicy.bypassList()
+	if list == nil {
+		return false
+	}
+
+	if len(hostname) == 0 {
+		hostname, _ = t2s.fakeIpHostname(dstIP)
+	}
+	if list.ContainsIp(dstIP) || (len(hostname) > 0 && list.ContainsHost(hostname)) {
+		log.Printf("Encrypted dns bypass to %s:%d (%s) rejected", dstIP, dstPort, hostname)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,596 @@
+package tun2socks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+	"github.com/getsentry/sentry-go"
+	"github.com/miekg/dns"
+)
+
+var (
+	dnsBufPool = &sync.Pool{
+		New: func() interface{} {
+			return make([]byte, dns.MaxMsgSize)
+		},
+	}
+)
+
+const (
+	DNS_CACHE_SIZE    = 4096
+	DNS_TIMEOUT       = 5 * time.Second
+	DNS_MAX_CACHE_TTL = 3600
+	DNS_NEGATIVE_TTL  = 60
+	// queries waiting for the upstream, more are dropped and retried by the app
+	DNS_MAX_FORWARDS = 256
+)
+
+// dnsUpstream resolves queries the engine can't answer itself
+type dnsUpstream interface {
+	Exchange(req *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+type dnsQuery struct {
+	t2s *Tun2Socks
+	msg *dns.Msg
+
+	srcIP   net.IP
+	dstIP   net.IP
+	srcPort uint16
+	dstPort uint16
+
+	uid      int
+	uidKnown bool
+
+	// proxy the app's flows are routed to, misses are resolved through it
+	proxy *ProxyServer
+
+	// answered by the policy with addresses that aren't the domain's, the
+	// host map doesn't learn them
+	altered bool
+}
+
+// Uid looks up the app owning the query on first use
+func (q *dnsQuery) Uid() int {
+	if !q.uidKnown {
+		q.uid = q.t2s.FindAppUid(q.srcIP.String(), q.srcPort, q.dstIP.String(), q.dstPort)
+		q.uidKnown = true
+	}
+	return q.uid
+}
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+type dnsCall struct {
+	done chan bool
+	resp *dns.Msg
+	err  error
+}
+
+type dnsServer struct {
+	t2s *Tun2Socks
+
+	cacheLock sync.Mutex
+	cache     map[string]*dnsCacheEntry
+
+	inflightLock sync.Mutex
+	inflight     map[string]*dnsCall
+
+	// a slot per query answered in its own goroutine
+	forwards chan bool
+}
+
+func newDnsServer(t2s *Tun2Socks) *dnsServer {
+	return &dnsServer{
+		t2s:      t2s,
+		cache:    make(map[string]*dnsCacheEntry),
+		inflight: make(map[string]*dnsCall),
+		forwards: make(chan bool, DNS_MAX_FORWARDS),
+	}
+}
+
+func dnsCacheKey(msg *dns.Msg) string {
+	q := msg.Question[0]
+	return fmt.Sprintf("%s|%d|%d", strings.ToLower(q.Name), q.Qtype, q.Qclass)
+}
+
+// handleUdp answers a query read from the tun. Queries the policy or the
+// cache answer are replied to right away, the others wait for the upstream in
+// a goroutine, at most DNS_MAX_FORWARDS at a time.
+func (d *dnsServer) handleUdp(raw []byte, ip *packet.Ip, udp *packet.UDP) {
+	req := new(dns.Msg)
+	if e := req.Unpack(udp.Payload); e != nil {
+		log.Printf("Error parsing dns query %s", e)
+		return
+	}
+	if len(req.Question) != 1 {
+		return
+	}
+
+	q := &dnsQuery{
+		t2s:     d.t2s,
+		msg:     req,
+		srcPort: udp.SrcPort,
+		dstPort: udp.DstPort,
+	}
+	q.srcIP = make(net.IP, len(ip.Src))
+	copy(q.srcIP, ip.Src)
+	q.dstIP = make(net.IP, len(ip.Dst))
+	copy(q.dstIP, ip.Dst)
+
+	if !d.routeQuery(q, packet.IPProtocolUDP) {
+		if action := d.t2s.rejectAction; action != REJECT_RESET {
+			d.t2s.writeCh <- unreachable(ip, raw, action)
+		}
+		return
+	}
+	if resp, ok := d.answerLocal(q); ok {
+		d.replyUdp(q, resp)
+		return
+	}
+
+	select {
+	case d.forwards <- true:
+	default:
+		log.Printf("Too many dns queries in flight, dropping %s", req.Question[0].Name)
+		return
+	}
+	go func() {
+		defer sentry.Recover()
+		defer func() { <-d.forwards }()
+
+		d.replyUdp(q, d.answer(q))
+	}()
+}
+
+// replyUdp writes the response to a udp query to the tun
+func (d *dnsServer) replyUdp(q *dnsQuery, resp *dns.Msg) {
+	if resp == nil {
+		return
+	}
+	resp.Truncate(dnsUdpSize(q.msg))
+	payload, e := resp.Pack()
+	if e != nil {
+		log.Printf("Error packing dns response %s", e)
+		return
+	}
+	if d.t2s.stopped {
+		return
+	}
+	pkt, fragments := responsePacket(q.srcIP, q.dstIP, q.srcPort, q.dstPort, payload, d.t2s.mtu)
+	if pkt != nil {
+		d.t2s.writeCh <- pkt
+	}
+	for _, frag := range fragments {
+		d.t2s.writeCh <- frag
+	}
+
+	d.record(q, resp)
+}
+
+// routeQuery applies the routing rules to a query from the tun, false if it's
+// rejected
+func (d *dnsServer) routeQuery(q *dnsQuery, protocol packet.IPProtocol) bool {
+	action, proxy := d.t2s.route(&RouteRequest{
+		Uid:      q.Uid(),
+		DstIP:    q.dstIP,
+		DstPort:  q.dstPort,
+		Protocol: protocol,
+	})
+	if action == ROUTE_REJECT {
+		log.Printf("dns query to %s rejected by routing rules", joinHostPort(q.dstIP, q.dstPort))
+		return false
+	}
+	if action == ROUTE_PROXY && proxy.ProxyType != PROXY_TYPE_NONE {
+		q.proxy = proxy
+	}
+	return true
+}
+
+func dnsUdpSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// answer resolves a query and learns the addresses of the response before
+// the app sees them and connects
+func (d *dnsServer) answer(q *dnsQuery) *dns.Msg {
+	resp, _ := d.resolve(q, true)
+	d.learn(q, resp)
+	return resp
+}
+
+// answerLocal is answer without the upstream, false if the query has to be
+// forwarded
+func (d *dnsServer) answerLocal(q *dnsQuery) (*dns.Msg, bool) {
+	resp, ok := d.resolve(q, false)
+	if ok {
+		d.learn(q, resp)
+	}
+	return resp, ok
+}
+
+func (d *dnsServer) learn(q *dnsQuery, resp *dns.Msg) {
+	if resp != nil && !q.altered {
+		d.t2s.hostMap.learn(resp)
+	}
+}
+
+// resolve answers a query read from the tun, the upstream is only asked if
+// remote is set. Returns whether the query was resolved, with a nil response
+// if it should be dropped.
+func (d *dnsServer) resolve(q *dnsQuery, remote bool) (*dns.Msg, bool) {
+	if policy := d.t2s.dnsPolicy; policy != nil {
+		// hosts entries are where the app connects, so they're learned
+		if resp := policy.hostsAnswer(q); resp != nil {
+			return resp, true
+		}
+		if resp := policy.apply(q); resp != nil {
+			q.altered = true
+			return resp, true
+		}
+		if target := policy.safeSearchTarget(q); len(target) > 0 {
+			if !remote {
+				return nil, false
+			}
+			q.altered = true
+			return d.safeSearchAnswer(q, target), true
+		}
+	}
+
+	if remote {
+		return d.lookup(q), true
+	}
+	if d.t2s.fakeIp {
+		if resp := d.fakeIpAnswer(q); resp != nil {
+			return resp, true
+		}
+	}
+	resp := d.cached(dnsCacheKey(q.msg), q.msg)
+	return resp, resp != nil
+}
+
+// lookup answers with a fake address in fake ip mode, from the upstream
+// otherwise
+func (d *dnsServer) lookup(q *dnsQuery) *dns.Msg {
+	if d.t2s.fakeIp {
+		if resp := d.fakeIpAnswer(q); resp != nil {
+			return resp
+		}
+	}
+
+	return d.forward(q)
+}
+
+// forward answers from the cache or the upstream, identical queries in flight
+// share one upstream exchange
+func (d *dnsServer) forward(q *dnsQuery) *dns.Msg {
+	key := dnsCacheKey(q.msg)
+	if resp := d.cached(key, q.msg); resp != nil {
+		return resp
+	}
+
+	resp, e := d.exchange(key, q)
+	if e != nil {
+		log.Printf("dns exchange for %s failed: %s", q.msg.Question[0].Name, e)
+		resp = new(dns.Msg)
+		resp.SetRcode(q.msg, dns.RcodeServerFailure)
+		return resp
+	}
+	return replyTo(q.msg, resp)
+}
+
+// lookupIp resolves a domain for the engine's own use, an address of the
+// other family is returned if the preferred one has none
+func (d *dnsServer) lookupIp(domain string, preferV6 bool, resolverIP net.IP, resolverPort uint16) (net.IP, error) {
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	if preferV6 {
+		qtypes = []uint16{dns.TypeAAAA, dns.TypeA}
+	}
+
+	for _, qtype := range qtypes {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(domain), qtype)
+		q := &dnsQuery{
+			t2s:      d.t2s,
+			msg:      msg,
+			dstIP:    resolverIP,
+			dstPort:  resolverPort,
+			uid:      -1,
+			uidKnown: true,
+		}
+		resp := d.forward(q)
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				return rr.A, nil
+			case *dns.AAAA:
+				return rr.AAAA, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no address for %s", domain)
+}
+
+// replyTo returns a copy of resp carrying the id of req
+func replyTo(req *dns.Msg, resp *dns.Msg) *dns.Msg {
+	reply := resp.Copy()
+	reply.Id = req.Id
+	return reply
+}
+
+func (d *dnsServer) exchange(key string, q *dnsQuery) (*dns.Msg, error) {
+	d.inflightLock.Lock()
+	if call, ok := d.inflight[key]; ok {
+		d.inflightLock.Unlock()
+		<-call.done
+		return call.resp, call.err
+	}
+	call := &dnsCall{done: make(chan bool)}
+	d.inflight[key] = call
+	d.inflightLock.Unlock()
+
+	call.resp, call.err = d.upstreamFor(q).Exchange(q.msg)
+	if call.err == nil {
+		d.store(key, call.resp)
+	}
+
+	d.inflightLock.Lock()
+	delete(d.inflight, key)
+	d.inflightLock.Unlock()
+	close(call.done)
+
+	return call.resp, call.err
+}
+
+// upstreamFor uses the encrypted or plain custom dns server if set, the
+// original destination otherwise. Plain servers are reached through the
+// query's proxy, encrypted ones follow their own proxy setting.
+func (d *dnsServer) upstreamFor(q *dnsQuery) dnsUpstream {
+	if upstream := d.t2s.dnsUpstream(); upstream != nil {
+		return upstream
+	}
+
+	targetIp := q.dstIP
+	port := q.dstPort
+	t2s := d.t2s
+	if t2s.customDnsHost4 != nil && (targetIp.To4() != nil || t2s.customDnsHost6 == nil) { //use v4 host if v6 is not set
+		targetIp = t2s.customDnsHost4
+		port = t2s.customDnsPort
+	} else if t2s.customDnsHost6 != nil && targetIp.To4() == nil {
+		targetIp = t2s.customDnsHost6
+		port = t2s.customDnsPort
+	}
+	return newUdpDnsUpstream(joinHostPort(targetIp, port), q.proxy)
+}
+
+func joinHostPort(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port))
+}
+
+func (d *dnsServer) cached(key string, req *dns.Msg) *dns.Msg {
+	d.cacheLock.Lock()
+	defer d.cacheLock.Unlock()
+
+	entry, ok := d.cache[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(entry.expires) {
+		delete(d.cache, key)
+		return nil
+	}
+
+	resp := replyTo(req, entry.msg)
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > age {
+				rr.Header().Ttl -= age
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return resp
+}
+
+func (d *dnsServer) store(key string, resp *dns.Msg) {
+	ttl := dnsCacheTtl(resp)
+	if ttl == 0 {
+		return
+	}
+
+	d.cacheLock.Lock()
+	defer d.cacheLock.Unlock()
+
+	now := time.Now()
+	if len(d.cache) >= DNS_CACHE_SIZE {
+		for k, entry := range d.cache {
+			if now.After(entry.expires) {
+				delete(d.cache, k)
+			}
+		}
+		// still full, drop arbitrary entries
+		for k := range d.cache {
+			if len(d.cache) < DNS_CACHE_SIZE {
+				break
+			}
+			delete(d.cache, k)
+		}
+	}
+
+	d.cache[key] = &dnsCacheEntry{
+		msg:     resp.Copy(),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// dnsCacheTtl returns how long a response may be cached, 0 for never
+func dnsCacheTtl(resp *dns.Msg) uint32 {
+	if resp.Truncated {
+		return 0
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		if len(resp.Answer) == 0 {
+			return negativeTtl(resp)
+		}
+	case dns.RcodeNameError:
+		return negativeTtl(resp)
+	default:
+		return 0
+	}
+
+	ttl := uint32(DNS_MAX_CACHE_TTL)
+	for _, rr := range resp.Answer {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+func negativeTtl(resp *dns.Msg) uint32 {
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+			if ttl > DNS_NEGATIVE_TTL {
+				ttl = DNS_NEGATIVE_TTL
+			}
+			return ttl
+		}
+	}
+	return 0
+}
+
+// udpDnsUpstream sends each query from its own socket, so every query gets a
+// random source port besides the random id. Through a proxy queries go over
+// tcp as proxies don't carry udp in general.
+type udpDnsUpstream struct {
+	address string
+	proxy   *ProxyServer
+}
+
+func newUdpDnsUpstream(address string, proxy *ProxyServer) *udpDnsUpstream {
+	return &udpDnsUpstream{
+		address: address,
+		proxy:   proxy,
+	}
+}
+
+func (u *udpDnsUpstream) String() string {
+	return "udp://" + u.address
+}
+
+func (u *udpDnsUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	if u.proxy != nil {
+		return u.exchangeTcp(req)
+	}
+
+	c, e := net.DialTimeout("udp", u.address, time.Second)
+	if e != nil {
+		return nil, e
+	}
+	defer c.Close()
+
+	out := req.Copy()
+	out.Id = dns.Id()
+	packed, e := out.Pack()
+	if e != nil {
+		return nil, e
+	}
+	c.SetDeadline(time.Now().Add(DNS_TIMEOUT))
+	if _, e = c.Write(packed); e != nil {
+		return nil, e
+	}
+
+	buf := dnsBufPool.Get().([]byte)
+	defer dnsBufPool.Put(buf)
+	for {
+		n, e := c.Read(buf)
+		if e != nil {
+			if netErr, ok := e.(net.Error); ok && netErr.Timeout() {
+				return nil, fmt.Errorf("timeout waiting for %s", u.address)
+			}
+			return nil, e
+		}
+		resp := new(dns.Msg)
+		if e := resp.Unpack(buf[:n]); e != nil {
+			continue
+		}
+		// spoofed answers have to guess the port, the id and the question
+		if resp.Id != out.Id || !sameQuestion(out, resp) {
+			continue
+		}
+		if resp.Truncated {
+			// answer didn't fit in a datagram, ask again over tcp
+			return u.exchangeTcp(req)
+		}
+		resp.Id = req.Id
+		return resp, nil
+	}
+}
+
+func (u *udpDnsUpstream) exchangeTcp(req *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DNS_TIMEOUT)
+	defer cancel()
+	c, e := dialThroughProxy(ctx, u.proxy, u.address)
+	if e != nil {
+		return nil, e
+	}
+	conn := &dns.Conn{Conn: c}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(DNS_TIMEOUT))
+	out := req.Copy()
+	out.Id = dns.Id()
+	if e = conn.WriteMsg(out); e != nil {
+		return nil, e
+	}
+	resp, e := conn.ReadMsg()
+	if e != nil {
+		return nil, e
+	}
+	if resp.Id != out.Id || !sameQuestion(out, resp) {
+		return nil, fmt.Errorf("mismatched answer from %s", u.address)
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// sameQuestion reports whether resp answers the question of req
+func sameQuestion(req *dns.Msg, resp *dns.Msg) bool {
+	if len(resp.Question) != len(req.Question) {
+		return false
+	}
+	for i, q := range req.Question {
+		r := resp.Question[i]
+		if r.Qtype != q.Qtype || r.Qclass != q.Qclass || !strings.EqualFold(r.Name, q.Name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,226 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+	"github.com/miekg/dns"
+)
+
+func TestUdpDnsUpstreamIgnoresMismatchedAnswers(t *testing.T) {
+	server, e := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		n, addr, e := server.ReadFromUDP(buf)
+		if e != nil {
+			return
+		}
+		req := new(dns.Msg)
+		if req.Unpack(buf[:n]) != nil {
+			return
+		}
+		reply := func(id uint16, name string, ip string) {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Id = id
+			resp.Question[0].Name = name
+			rr, _ := dns.NewRR(name + " 60 IN A " + ip)
+			resp.Answer = append(resp.Answer, rr)
+			packed, _ := resp.Pack()
+			server.WriteToUDP(packed, addr)
+		}
+		reply(req.Id+1, req.Question[0].Name, "6.6.6.6")
+		reply(req.Id, "evil.example.", "6.6.6.6")
+		reply(req.Id, req.Question[0].Name, "1.2.3.4")
+	}()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 4242
+	resp, e := newUdpDnsUpstream(server.LocalAddr().String(), nil).Exchange(req)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if resp.Id != 4242 {
+		t.Errorf("answer carries id %d", resp.Id)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("accepted %v", resp.Answer)
+	}
+}
+
+func TestDnsQueryRejectedByRoutingRules(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	payload, _ := query.Pack()
+	resolver := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53}
+
+	for _, action := range []int{REJECT_RESET, REJECT_ICMP_PORT} {
+		t2s := newTestEngine()
+		router := NewRouter()
+		rule, e := NewRoutingRule(ROUTE_REJECT, "", "", "", "", "53", "", int(packet.IPProtocolUDP))
+		if e != nil {
+			t.Fatal(e)
+		}
+		router.AddRule(rule)
+		t2s.SetRouter(router)
+		t2s.SetRejectAction(action)
+
+		raw, ip, udp := clientUDP(t, resolver, payload)
+		t2s.udp(raw, ip, udp)
+
+		pkt := nextWrite(t2s, 500*time.Millisecond)
+		if action == REJECT_RESET {
+			if pkt != nil {
+				t.Errorf("dropped query answered with %T", pkt)
+			}
+			continue
+		}
+		icmp, ok := pkt.(*ipPacket)
+		if !ok {
+			t.Fatalf("rejected query answered with %T", pkt)
+		}
+		reply := parseWire(t, icmp.wire)
+		if reply.GetNextProto() != packet.IPProtocolICMPv4 || reply.Payload[0] != packet.ICMPv4TypeDestUnreachable || reply.Payload[1] != packet.ICMPv4CodePortUnreachable {
+			t.Errorf("rejected query answered with %v %v", reply.GetNextProto(), reply.Payload[:2])
+		}
+	}
+}
+
+func TestDnsMissResolvedThroughAppProxy(t *testing.T) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	seen := make(chan string, 1)
+	server := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		seen <- w.RemoteAddr().Network()
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+		resp.Answer = append(resp.Answer, rr)
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	proxyLn, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer proxyLn.Close()
+	go serveSocks(proxyLn)
+
+	t2s := newTestEngine()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: proxyLn.Addr().String()})
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	payload, _ := query.Pack()
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: ln.Addr().(*net.TCPAddr).Port}
+	raw, ip, udp := clientUDP(t, dst, payload)
+	t2s.dnsServer.handleUdp(raw, ip, udp)
+
+	select {
+	case network := <-seen:
+		if network != "tcp" {
+			t.Errorf("query reached the server over %s", network)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query never reached the server through the proxy")
+	}
+	pkt, ok := nextWrite(t2s, 5*time.Second).(*udpPacket)
+	if !ok {
+		t.Fatal("no answer written to the tun")
+	}
+	resp := new(dns.Msg)
+	if e := resp.Unpack(pkt.udp.Payload); e != nil {
+		t.Fatal(e)
+	}
+	if resp.Id != query.Id || len(resp.Answer) != 1 {
+		t.Errorf("answer %v", resp)
+	}
+}
+
+func TestDnsUpstreamSwap(t *testing.T) {
+	t2s := newTestEngine()
+	q := &dnsQuery{t2s: t2s, dstIP: net.IPv4(192, 0, 2, 53), dstPort: 53}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			_ = t2s.dnsServer.upstreamFor(q).String()
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		url := "https://dns.example/dns-query"
+		if i%2 == 1 {
+			url = ""
+		}
+		if e := t2s.SetDnsUrl(url, nil); e != nil {
+			t.Fatal(e)
+		}
+	}
+	<-done
+}
+
+func TestHostsAnswerLearned(t *testing.T) {
+	t2s := newTestEngine()
+	hosts := NewHostsTable()
+	hosts.Add("pinned.example", "192.0.2.7")
+	policy := NewDnsPolicy()
+	policy.SetHosts(hosts)
+	t2s.SetDnsPolicy(policy)
+
+	query := new(dns.Msg)
+	query.SetQuestion("pinned.example.", dns.TypeA)
+	resp := t2s.dnsServer.answer(&dnsQuery{t2s: t2s, msg: query})
+	if resp == nil || len(resp.Answer) != 1 {
+		t.Fatalf("hosts answer %v", resp)
+	}
+	if host := t2s.hostMap.lookup(net.IPv4(192, 0, 2, 7)); host != "pinned.example" {
+		t.Errorf("host map has %q", host)
+	}
+}
+
+func TestDnsCacheHitAnsweredInline(t *testing.T) {
+	t2s := newTestEngine()
+	query := new(dns.Msg)
+	query.SetQuestion("cached.example.", dns.TypeA)
+	cached := new(dns.Msg)
+	cached.SetReply(query)
+	rr, _ := dns.NewRR("cached.example. 60 IN A 192.0.2.8")
+	cached.Answer = append(cached.Answer, rr)
+	t2s.dnsServer.store(dnsCacheKey(query), cached)
+
+	// every forward slot taken, only the cache can answer
+	for i := 0; i < DNS_MAX_FORWARDS; i++ {
+		t2s.dnsServer.forwards <- true
+	}
+	payload, _ := query.Pack()
+	raw, ip, udp := clientUDP(t, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53}, payload)
+	t2s.udp(raw, ip, udp)
+	if len(t2s.writeCh) != 1 {
+		t.Fatalf("%d packets written after the cache hit", len(t2s.writeCh))
+	}
+	pkt := (<-t2s.writeCh).(*udpPacket)
+	resp := new(dns.Msg)
+	if e := resp.Unpack(pkt.udp.Payload); e != nil || len(resp.Answer) != 1 {
+		t.Fatalf("answer %v %v", resp, e)
+	}
+
+	// a miss waits for a slot that never frees, it's dropped
+	query.SetQuestion("uncached.example.", dns.TypeA)
+	payload, _ = query.Pack()
+	raw, ip, udp = clientUDP(t, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53}, payload)
+	t2s.udp(raw, ip, udp)
+	if pkt := nextWrite(t2s, 100*time.Millisecond); pkt != nil {
+		t.Errorf("query over the forward limit answered with %T", pkt)
+	}
+}
@@ -0,0 +1,99 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+	"github.com/getsentry/sentry-go"
+	"github.com/miekg/dns"
+)
+
+const (
+	// RFC 7766 recommends closing idle connections after a few seconds
+	DNS_TCP_IDLE_TIMEOUT = 10 * time.Second
+)
+
+// serveTcp terminates a tcp dns connection of the tun in the engine, the
+// returned conn takes the place of the upstream connection of the track
+func (d *dnsServer) serveTcp(tt *tcpConnTrack) (*gosocks.SocksConn, error) {
+	template := &dnsQuery{
+		t2s:      d.t2s,
+		srcIP:    tt.localIP,
+		dstIP:    tt.remoteIP,
+		srcPort:  tt.localPort,
+		dstPort:  tt.remotePort,
+		uid:      tt.uid,
+		uidKnown: tt.uid != -1,
+	}
+	if !d.routeQuery(template, packet.IPProtocolTCP) {
+		return nil, fmt.Errorf("dns to %s rejected by routing rules", joinHostPort(tt.remoteIP, tt.remotePort))
+	}
+	client, server := net.Pipe()
+	go d.handleTcp(server, template)
+	return &gosocks.SocksConn{Conn: client, Timeout: DNS_TIMEOUT}, nil
+}
+
+// handleTcp reads length prefixed queries until the client closes or goes
+// idle, pipelined queries are answered as soon as each one resolves
+func (d *dnsServer) handleTcp(conn net.Conn, template *dnsQuery) {
+	defer sentry.Recover()
+	defer conn.Close()
+
+	var writeLock sync.Mutex
+	var length [2]byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(DNS_TCP_IDLE_TIMEOUT))
+		if _, e := io.ReadFull(conn, length[:]); e != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, e := io.ReadFull(conn, buf); e != nil {
+			return
+		}
+
+		req := new(dns.Msg)
+		if e := req.Unpack(buf); e != nil {
+			log.Printf("Error parsing tcp dns query %s", e)
+			return
+		}
+		if len(req.Question) != 1 {
+			continue
+		}
+
+		q := *template
+		q.msg = req
+		go func() {
+			defer sentry.Recover()
+
+			resp := d.answer(&q)
+			if resp == nil {
+				return
+			}
+			payload, e := resp.Pack()
+			if e != nil {
+				log.Printf("Error packing dns response %s", e)
+				return
+			}
+			out := make([]byte, 2+len(payload))
+			binary.BigEndian.PutUint16(out, uint16(len(payload)))
+			copy(out[2:], payload)
+
+			writeLock.Lock()
+			conn.SetWriteDeadline(time.Now().Add(DNS_TIMEOUT))
+			_, e = conn.Write(out)
+			writeLock.Unlock()
+			if e != nil {
+				return
+			}
+
+			d.record(&q, resp)
+		}()
+	}
+}
@@ -0,0 +1,90 @@
+package tun2socks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DOH_MEDIA_TYPE = "application/dns-message"
+)
+
+// dohUpstream sends queries as RFC 8484 POST requests, the transport keeps
+// the http/2 connection to the server open between queries
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newDohUpstream(url string, proxy *ProxyServer) *dohUpstream {
+	transport := &http.Transport{
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: DNS_TIMEOUT,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialThroughProxy(ctx, proxy, address)
+		},
+	}
+	return &dohUpstream{
+		url: url,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   DNS_TIMEOUT,
+		},
+	}
+}
+
+func (u *dohUpstream) String() string {
+	return u.url
+}
+
+func (u *dohUpstream) Close() error {
+	u.client.CloseIdleConnections()
+	return nil
+}
+
+func (u *dohUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	out := req.Copy()
+	// RFC 8484 4.1, id 0 keeps requests cache friendly
+	out.Id = 0
+	packed, e := out.Pack()
+	if e != nil {
+		return nil, e
+	}
+
+	httpReq, e := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(packed))
+	if e != nil {
+		return nil, e
+	}
+	httpReq.Header.Set("Content-Type", DOH_MEDIA_TYPE)
+	httpReq.Header.Set("Accept", DOH_MEDIA_TYPE)
+
+	httpResp, e := u.client.Do(httpReq)
+	if e != nil {
+		return nil, e
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s replied %s", u.url, httpResp.Status)
+	}
+	body, e := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if e != nil {
+		return nil, e
+	}
+
+	resp := new(dns.Msg)
+	if e = resp.Unpack(body); e != nil {
+		return nil, e
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
@@ -0,0 +1,77 @@
+package tun2socks
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestDohUpstream points an upstream at server, trusting its certificate
+func newTestDohUpstream(server *httptest.Server) *dohUpstream {
+	u := newDohUpstream(server.URL+"/dns-query", nil)
+	u.client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	return u
+}
+
+func TestDohExchange(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/dns-query" {
+			t.Errorf("%s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Content-Type") != DOH_MEDIA_TYPE || r.Header.Get("Accept") != DOH_MEDIA_TYPE {
+			t.Errorf("content type %q accept %q", r.Header.Get("Content-Type"), r.Header.Get("Accept"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if e := req.Unpack(body); e != nil {
+			t.Errorf("unpack: %s", e)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Id != 0 {
+			t.Errorf("query id %d", req.Id)
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.9")
+		resp.Answer = append(resp.Answer, rr)
+		packed, _ := resp.Pack()
+		w.Header().Set("Content-Type", DOH_MEDIA_TYPE)
+		w.Write(packed)
+	}))
+	defer server.Close()
+	u := newTestDohUpstream(server)
+	defer u.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 4321
+	resp, e := u.Exchange(req)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if resp.Id != 4321 || len(resp.Answer) != 1 {
+		t.Errorf("response %v", resp)
+	}
+	if req.Id != 4321 {
+		t.Errorf("query id changed to %d", req.Id)
+	}
+}
+
+func TestDohNonOkStatus(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	u := newTestDohUpstream(server)
+	defer u.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if resp, e := u.Exchange(req); e == nil {
+		t.Errorf("503 accepted as %v", resp)
+	}
+}
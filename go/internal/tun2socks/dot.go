@@ -0,0 +1,278 @@
+package tun2socks
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/miekg/dns"
+)
+
+const (
+	DOT_PORT      = "853"
+	DOT_POOL_SIZE = 2
+)
+
+// dotConn is one persistent RFC 7858 connection, queries are pipelined and
+// matched to responses by remapped id
+type dotConn struct {
+	conn net.Conn
+
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	closed  bool
+}
+
+// dotDial is a pool slot being dialed, queries picking the slot meanwhile
+// wait for it
+type dotDial struct {
+	done chan bool
+	conn *dotConn
+	err  error
+}
+
+// dotUpstream keeps a small pool of DNS-over-TLS connections and reconnects
+// them when the server closes them
+type dotUpstream struct {
+	address    string
+	serverName string
+	proxy      *ProxyServer
+
+	lock    sync.Mutex
+	conns   [DOT_POOL_SIZE]*dotConn
+	dialing [DOT_POOL_SIZE]*dotDial
+	next    int
+	closed  bool
+}
+
+// newDotUpstream takes host[:port] from a tls:// url
+func newDotUpstream(hostPort string, proxy *ProxyServer) *dotUpstream {
+	host, port, e := net.SplitHostPort(hostPort)
+	if e != nil {
+		host = hostPort
+		port = DOT_PORT
+	}
+	return &dotUpstream{
+		address:    net.JoinHostPort(host, port),
+		serverName: host,
+		proxy:      proxy,
+	}
+}
+
+func (u *dotUpstream) String() string {
+	return "tls://" + u.address
+}
+
+func (u *dotUpstream) Close() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.closed = true
+	for i, c := range u.conns {
+		if c != nil {
+			c.close()
+			u.conns[i] = nil
+		}
+	}
+	return nil
+}
+
+func (u *dotUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	var e error
+	// a pooled connection may have been closed by the server while idle,
+	// retry once on a fresh one
+	for attempt := 0; attempt < 2; attempt++ {
+		var c *dotConn
+		c, e = u.pick()
+		if e != nil {
+			return nil, e
+		}
+		var resp *dns.Msg
+		resp, e = c.exchange(req)
+		if e == nil {
+			return resp, nil
+		}
+		if !c.isClosed() {
+			return nil, e
+		}
+	}
+	return nil, e
+}
+
+// pick returns the next pooled connection, dialing it if needed. The slot is
+// reserved while dialing so a slow server doesn't hold the lock through the
+// handshake.
+func (u *dotUpstream) pick() (*dotConn, error) {
+	u.lock.Lock()
+	if u.closed {
+		u.lock.Unlock()
+		return nil, fmt.Errorf("%s closed", u)
+	}
+	slot := u.next
+	u.next = (u.next + 1) % DOT_POOL_SIZE
+	if c := u.conns[slot]; c != nil && !c.isClosed() {
+		u.lock.Unlock()
+		return c, nil
+	}
+	if dial := u.dialing[slot]; dial != nil {
+		u.lock.Unlock()
+		<-dial.done
+		return dial.conn, dial.err
+	}
+	dial := &dotDial{done: make(chan bool)}
+	u.dialing[slot] = dial
+	u.lock.Unlock()
+
+	dial.conn, dial.err = u.dial()
+
+	u.lock.Lock()
+	u.dialing[slot] = nil
+	if dial.err == nil {
+		if u.closed {
+			dial.conn.close()
+			dial.conn, dial.err = nil, fmt.Errorf("%s closed", u)
+		} else {
+			u.conns[slot] = dial.conn
+		}
+	}
+	u.lock.Unlock()
+	close(dial.done)
+	return dial.conn, dial.err
+}
+
+func (u *dotUpstream) dial() (*dotConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DNS_TIMEOUT)
+	defer cancel()
+	raw, e := dialThroughProxy(ctx, u.proxy, u.address)
+	if e != nil {
+		return nil, e
+	}
+	tlsConn := tls.Client(raw, &tls.Config{ServerName: u.serverName})
+	if e = tlsConn.HandshakeContext(ctx); e != nil {
+		raw.Close()
+		return nil, e
+	}
+
+	c := &dotConn{
+		conn:    tlsConn,
+		pending: make(map[uint16]chan *dns.Msg),
+	}
+	go c.reader()
+	return c, nil
+}
+
+func (c *dotConn) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+// close fails all queries waiting on the connection
+func (c *dotConn) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *dotConn) exchange(req *dns.Msg) (*dns.Msg, error) {
+	ch := make(chan *dns.Msg, 1)
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil, fmt.Errorf("connection closed")
+	}
+	id := dns.Id()
+	for c.pending[id] != nil {
+		id = dns.Id()
+	}
+	c.pending[id] = ch
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+	}()
+
+	out := req.Copy()
+	out.Id = id
+	packed, e := out.Pack()
+	if e != nil {
+		return nil, e
+	}
+	buf := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	copy(buf[2:], packed)
+
+	c.writeLock.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(DNS_TIMEOUT))
+	_, e = c.conn.Write(buf)
+	c.writeLock.Unlock()
+	if e != nil {
+		c.close()
+		return nil, e
+	}
+
+	timer := time.NewTimer(DNS_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("connection closed")
+		}
+		resp.Id = req.Id
+		return resp, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("timeout waiting for dns over tls response")
+	}
+}
+
+func (c *dotConn) reader() {
+	defer sentry.Recover()
+	defer c.close()
+
+	var length [2]byte
+	for {
+		if _, e := io.ReadFull(c.conn, length[:]); e != nil {
+			if e != io.EOF {
+				log.Printf("dns over tls read error: %s", e)
+			}
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, e := io.ReadFull(c.conn, buf); e != nil {
+			log.Printf("dns over tls read error: %s", e)
+			return
+		}
+
+		resp := new(dns.Msg)
+		if e := resp.Unpack(buf); e != nil {
+			continue
+		}
+
+		c.lock.Lock()
+		ch := c.pending[resp.Id]
+		delete(c.pending, resp.Id)
+		c.lock.Unlock()
+		if ch != nil {
+			ch <- resp
+		}
+	}
+}
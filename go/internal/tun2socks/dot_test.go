@@ -0,0 +1,50 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDotPickDialsOutsideTheLock(t *testing.T) {
+	// accepts but never answers the handshake
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			time.AfterFunc(time.Second, func() { c.Close() })
+		}
+	}()
+
+	u := newDotUpstream(ln.Addr().String(), nil)
+	picked := make(chan error, 1)
+	go func() {
+		_, e := u.pick()
+		picked <- e
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	u.Close()
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("Close waited %s for a handshake", waited)
+	}
+	select {
+	case e := <-picked:
+		if e == nil {
+			t.Error("pick succeeded on a closed upstream")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("pick never returned")
+	}
+	if _, e := u.pick(); e == nil {
+		t.Error("pick after Close succeeded")
+	}
+}
@@ -0,0 +1,153 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	FAKE_IP_TTL        = 1
+	FAKE_IP_POOL_SIZE  = 1 << 17
+	FAKE_IP_NETWORK_V4 = "198.18.0.0/15"
+	FAKE_IP_NETWORK_V6 = "fdfe:dcba:9876::/64"
+)
+
+type fakeIpEntry struct {
+	domain string
+	// resolver the app asked, used to find the real address
+	resolverIP   net.IP
+	resolverPort uint16
+}
+
+// fakeIpPool hands out synthetic addresses for domains and remembers the
+// mapping, addresses are recycled in order once the pool is exhausted
+type fakeIpPool struct {
+	lock sync.Mutex
+
+	network4 *net.IPNet
+	network6 *net.IPNet
+	next4    uint32
+	next6    uint32
+
+	entries   map[string]*fakeIpEntry
+	domainIp4 map[string]net.IP
+	domainIp6 map[string]net.IP
+}
+
+func newFakeIpPool() *fakeIpPool {
+	_, network4, _ := net.ParseCIDR(FAKE_IP_NETWORK_V4)
+	_, network6, _ := net.ParseCIDR(FAKE_IP_NETWORK_V6)
+	return &fakeIpPool{
+		network4:  network4,
+		network6:  network6,
+		entries:   make(map[string]*fakeIpEntry),
+		domainIp4: make(map[string]net.IP),
+		domainIp6: make(map[string]net.IP),
+	}
+}
+
+func (p *fakeIpPool) contains(ip net.IP) bool {
+	return p.network4.Contains(ip) || p.network6.Contains(ip)
+}
+
+// allocate returns the fake address of the domain, mapping it first if needed
+func (p *fakeIpPool) allocate(domain string, v6 bool, resolverIP net.IP, resolverPort uint16) net.IP {
+	domain = strings.ToLower(domain)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	domainIps := p.domainIp4
+	if v6 {
+		domainIps = p.domainIp6
+	}
+	if ip, ok := domainIps[domain]; ok {
+		return ip
+	}
+
+	var ip net.IP
+	if v6 {
+		ip = make(net.IP, net.IPv6len)
+		copy(ip, p.network6.IP)
+		// skip the subnet address
+		p.next6 = p.next6%(FAKE_IP_POOL_SIZE-1) + 1
+		binary.BigEndian.PutUint32(ip[12:], p.next6)
+	} else {
+		ip = make(net.IP, net.IPv4len)
+		copy(ip, p.network4.IP.To4())
+		// skip the subnet and the broadcast addresses
+		p.next4 = p.next4%(FAKE_IP_POOL_SIZE-2) + 1
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip)+p.next4)
+	}
+
+	if old, ok := p.entries[ip.String()]; ok {
+		delete(domainIps, old.domain)
+	}
+	p.entries[ip.String()] = &fakeIpEntry{
+		domain:       domain,
+		resolverIP:   resolverIP,
+		resolverPort: resolverPort,
+	}
+	domainIps[domain] = ip
+	return ip
+}
+
+func (p *fakeIpPool) lookup(ip net.IP) *fakeIpEntry {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.entries[ip.String()]
+}
+
+// fakeIpAnswer synthesizes the answer to an A or AAAA query in fake ip mode,
+// nil if the query has to be forwarded
+func (d *dnsServer) fakeIpAnswer(q *dnsQuery) *dns.Msg {
+	question := q.msg.Question[0]
+	if question.Qclass != dns.ClassINET || (question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA) {
+		return nil
+	}
+
+	domain := strings.TrimSuffix(question.Name, ".")
+	v6 := question.Qtype == dns.TypeAAAA
+	ip := d.t2s.fakeIpPool.allocate(domain, v6, q.dstIP, q.dstPort)
+
+	resp := new(dns.Msg)
+	resp.SetReply(q.msg)
+	resp.RecursionAvailable = true
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: FAKE_IP_TTL}
+	if v6 {
+		resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+	} else {
+		resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip})
+	}
+	return resp
+}
+
+// fakeIpHostname returns the domain behind a fake address
+func (t2s *Tun2Socks) fakeIpHostname(ip net.IP) (string, bool) {
+	if !t2s.fakeIpPool.contains(ip) {
+		return "", false
+	}
+	entry := t2s.fakeIpPool.lookup(ip)
+	if entry == nil {
+		return "", false
+	}
+	return entry.domain, true
+}
+
+// realIp resolves the domain behind a fake address through the resolver the
+// app asked, other addresses are returned as is
+func (t2s *Tun2Socks) realIp(ip net.IP) (net.IP, error) {
+	if !t2s.fakeIpPool.contains(ip) {
+		return ip, nil
+	}
+	entry := t2s.fakeIpPool.lookup(ip)
+	if entry == nil {
+		return nil, fmt.Errorf("unknown fake ip %s", ip)
+	}
+	return t2s.dnsServer.lookupIp(entry.domain, ip.To4() == nil, entry.resolverIP, entry.resolverPort)
+}
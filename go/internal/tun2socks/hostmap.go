@@ -0,0 +1,127 @@
+package tun2socks
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	HOST_MAP_SIZE = 16384
+	// apps keep using addresses well past the record TTL
+	HOST_MAP_MIN_TTL = 10 * time.Minute
+	HOST_MAP_MAX_TTL = 24 * time.Hour
+)
+
+type hostMapEntry struct {
+	hostname string
+	expires  time.Time
+}
+
+// hostMap remembers which name an address was resolved for, learned from the
+// dns answers seen by the engine, so flows without SNI still get a hostname
+type hostMap struct {
+	lock    sync.RWMutex
+	entries map[string]*hostMapEntry
+}
+
+func newHostMap() *hostMap {
+	return &hostMap{
+		entries: make(map[string]*hostMapEntry),
+	}
+}
+
+func (m *hostMap) lookup(ip net.IP) string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	entry, ok := m.entries[ip.String()]
+	if !ok || time.Now().After(entry.expires) {
+		return ""
+	}
+	return entry.hostname
+}
+
+// learn maps the A/AAAA answers of a response to the queried name, answers
+// reached through a CNAME chain map to the name the app asked for
+func (m *hostMap) learn(resp *dns.Msg) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Question) != 1 || len(resp.Answer) == 0 {
+		return
+	}
+	hostname := normalizeDomain(resp.Question[0].Name)
+	if len(hostname) == 0 {
+		return
+	}
+
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if ip.IsUnspecified() {
+			continue
+		}
+
+		ttl := time.Duration(rr.Header().Ttl) * time.Second
+		if ttl < HOST_MAP_MIN_TTL {
+			ttl = HOST_MAP_MIN_TTL
+		} else if ttl > HOST_MAP_MAX_TTL {
+			ttl = HOST_MAP_MAX_TTL
+		}
+		if len(m.entries) >= HOST_MAP_SIZE {
+			m.evict(now)
+		}
+		m.entries[ip.String()] = &hostMapEntry{
+			hostname: hostname,
+			expires:  now.Add(ttl),
+		}
+	}
+}
+
+// learnPacked learns from a response in wire format
+func (m *hostMap) learnPacked(data []byte) {
+	resp := new(dns.Msg)
+	if e := resp.Unpack(data); e != nil {
+		return
+	}
+	m.learn(resp)
+}
+
+// evict drops expired entries, or an arbitrary eighth of the map if none
+// expired. Called with the lock held.
+func (m *hostMap) evict(now time.Time) {
+	for key, entry := range m.entries {
+		if now.After(entry.expires) {
+			delete(m.entries, key)
+		}
+	}
+	if len(m.entries) < HOST_MAP_SIZE {
+		return
+	}
+	drop := HOST_MAP_SIZE / 8
+	for key := range m.entries {
+		delete(m.entries, key)
+		drop--
+		if drop == 0 {
+			break
+		}
+	}
+}
+
+// lookupHostname returns the name a flow's destination was resolved for, from
+// the fake ip pool or the learned answers
+func (t2s *Tun2Socks) lookupHostname(ip net.IP) string {
+	if hostname, ok := t2s.fakeIpHostname(ip); ok {
+		return hostname
+	}
+	return t2s.hostMap.lookup(ip)
+}
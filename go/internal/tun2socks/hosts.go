@@ -0,0 +1,137 @@
+package tun2socks
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	HOSTS_TTL = 60
+)
+
+type hostsEntry struct {
+	ip4 []net.IP
+	ip6 []net.IP
+}
+
+// HostsTable pins names to addresses ahead of the upstream, "*.example.com"
+// covers every subdomain of example.com
+type HostsTable struct {
+	exact    map[string]*hostsEntry
+	wildcard map[string]*hostsEntry
+}
+
+func NewHostsTable() *HostsTable {
+	return &HostsTable{
+		exact:    make(map[string]*hostsEntry),
+		wildcard: make(map[string]*hostsEntry),
+	}
+}
+
+// Add pins a name to one more address, returns false if ip isn't an address
+func (h *HostsTable) Add(name string, ip string) bool {
+	addr := net.ParseIP(strings.TrimSpace(ip))
+	name = normalizeDomain(name)
+	if addr == nil || len(name) == 0 {
+		return false
+	}
+
+	table := h.exact
+	if strings.HasPrefix(name, "*.") {
+		table = h.wildcard
+		name = name[2:]
+	}
+	entry, ok := table[name]
+	if !ok {
+		entry = &hostsEntry{}
+		table[name] = entry
+	}
+	if addr.To4() != nil {
+		entry.ip4 = append(entry.ip4, addr.To4())
+	} else {
+		entry.ip6 = append(entry.ip6, addr)
+	}
+	return true
+}
+
+// Load reads hosts file lines, an address followed by names, returns the
+// number of names added
+func (h *HostsTable) Load(r io.Reader) (int, error) {
+	count := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, name := range fields[1:] {
+			if h.Add(name, fields[0]) {
+				count++
+			}
+		}
+	}
+	return count, scanner.Err()
+}
+
+func (h *HostsTable) LoadFile(path string) (int, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return 0, e
+	}
+	defer f.Close()
+	return h.Load(f)
+}
+
+// lookup returns the exact entry or the closest wildcard covering name
+func (h *HostsTable) lookup(name string) *hostsEntry {
+	name = normalizeDomain(name)
+	if entry, ok := h.exact[name]; ok {
+		return entry
+	}
+	for {
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			return nil
+		}
+		name = name[dot+1:]
+		if entry, ok := h.wildcard[name]; ok {
+			return entry
+		}
+	}
+}
+
+// answer synthesizes the response for a pinned name, nil if the name isn't
+// in the table. Types other than A/AAAA get an empty answer so the upstream
+// can't contradict the table.
+func (h *HostsTable) answer(req *dns.Msg) *dns.Msg {
+	question := req.Question[0]
+	entry := h.lookup(question.Name)
+	if entry == nil {
+		return nil
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: HOSTS_TTL}
+	switch question.Qtype {
+	case dns.TypeA:
+		for _, ip := range entry.ip4 {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip})
+		}
+	case dns.TypeAAAA:
+		for _, ip := range entry.ip6 {
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return resp
+}
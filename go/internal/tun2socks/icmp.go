@@ -0,0 +1,81 @@
+package tun2socks
+
+import (
+	"net"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+const (
+	// how flows that are rejected or fail to dial are refused
+	REJECT_RESET      = 0 // tcp gets a RST, udp is dropped
+	REJECT_ICMP_PORT  = 1 // ICMP port unreachable
+	REJECT_ICMP_ADMIN = 2 // ICMP administratively prohibited
+)
+
+// unreachable builds the ICMP destination unreachable answer to a packet read
+// from the tun, raw is the whole packet and action picks the code
+func unreachable(ip *packet.Ip, raw []byte, action int) *ipPacket {
+	icmp := packet.NewICMP()
+	defer packet.ReleaseICMP(icmp)
+
+	quote := raw
+	if ip.Version == 4 {
+		icmp.Type = packet.ICMPv4TypeDestUnreachable
+		icmp.Code = packet.ICMPv4CodeAdminProhibited
+		if action == REJECT_ICMP_PORT {
+			icmp.Code = packet.ICMPv4CodePortUnreachable
+		}
+		if len(quote) > packet.ICMPv4_MAX_ERROR_QUOTE {
+			quote = quote[:packet.ICMPv4_MAX_ERROR_QUOTE]
+		}
+	} else {
+		icmp.Type = packet.ICMPv6TypeDestUnreachable
+		icmp.Code = packet.ICMPv6CodeAdminProhibited
+		if action == REJECT_ICMP_PORT {
+			icmp.Code = packet.ICMPv6CodePortUnreachable
+		}
+		if len(quote) > packet.ICMPv6_MAX_ERROR_QUOTE {
+			quote = quote[:packet.ICMPv6_MAX_ERROR_QUOTE]
+		}
+	}
+	return icmpPacket(ip.Dst, ip.Src, icmp, quote)
+}
+
+// icmpPacket builds an ICMP message from src to dst, the family follows src.
+// payload plus the headers has to fit in MTU.
+func icmpPacket(src net.IP, dst net.IP, icmp *packet.ICMP, payload []byte) *ipPacket {
+	var resp *packet.Ip
+	if src.To4() != nil {
+		resp = packet.NewIP4()
+		resp.V4.Id = packet.IPID()
+		resp.SetNextProto(packet.IPProtocolICMPv4)
+	} else {
+		resp = packet.NewIP6()
+		resp.SetNextProto(packet.IPProtocolICMPv6)
+	}
+	resp.SetHopLimit(64)
+	resp.Src = make(net.IP, len(src))
+	copy(resp.Src, src)
+	resp.Dst = make(net.IP, len(dst))
+	copy(resp.Dst, dst)
+
+	pkt := &ipPacket{ip: resp}
+	pkt.mtuBuf = newBuffer()
+
+	payloadStart := MTU - len(payload)
+	icmpStart := payloadStart - packet.ICMP_HEADER_LENGTH
+	copy(pkt.mtuBuf[payloadStart:], payload)
+	if resp.Version == 4 {
+		icmp.Serialize(pkt.mtuBuf[icmpStart:payloadStart], pkt.mtuBuf[icmpStart:])
+	} else {
+		// ICMPv6 checksum covers the pseudo header too
+		pseudoStart := icmpStart - packet.IP6_PSEUDO_LENGTH
+		resp.PseudoHeader(pkt.mtuBuf[pseudoStart:icmpStart], packet.IPProtocolICMPv6, MTU-icmpStart)
+		icmp.Serialize(pkt.mtuBuf[icmpStart:payloadStart], pkt.mtuBuf[pseudoStart:])
+	}
+	ipStart := icmpStart - resp.HeaderLength()
+	resp.Serialize(pkt.mtuBuf[ipStart:icmpStart], MTU-icmpStart)
+	pkt.wire = pkt.mtuBuf[ipStart:]
+	return pkt
+}
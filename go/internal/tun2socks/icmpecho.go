@@ -0,0 +1,222 @@
+package tun2socks
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+	"github.com/getsentry/sentry-go"
+)
+
+const (
+	// echo tracks close after this long without a request
+	ICMP_ECHO_TIMEOUT = 30 * time.Second
+)
+
+// icmpEchoTrack relays the echo requests of one ping (source, destination and
+// identifier) through an unprivileged ping socket. The kernel picks the
+// identifier on the wire, replies get the client's one back.
+type icmpEchoTrack struct {
+	t2s *Tun2Socks
+	id  string
+
+	fromTunCh   chan []byte
+	quitBySelf  chan bool
+	quitByOther chan bool
+
+	localIP  net.IP
+	remoteIP net.IP
+	echoId   uint16
+}
+
+func icmpEchoID(ip *packet.Ip, icmp *packet.ICMP) string {
+	return strings.Join([]string{
+		ip.Src.String(),
+		ip.Dst.String(),
+		fmt.Sprintf("%d", icmp.Id()),
+	}, "|")
+}
+
+// listenPing opens an ICMP datagram socket, allowed without raw socket
+// privileges for the groups in net.ipv4.ping_group_range
+func listenPing(v6 bool) (*net.UDPConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	var addr syscall.Sockaddr = &syscall.SockaddrInet4{}
+	if v6 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+		addr = &syscall.SockaddrInet6{}
+	}
+	fd, e := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if e != nil {
+		return nil, os.NewSyscallError("socket", e)
+	}
+	syscall.CloseOnExec(fd)
+	if e = syscall.Bind(fd, addr); e != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", e)
+	}
+
+	f := os.NewFile(uintptr(fd), "ping")
+	defer f.Close()
+	conn, e := net.FilePacketConn(f)
+	if e != nil {
+		return nil, e
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func (t2s *Tun2Socks) icmp(ip *packet.Ip) {
+	icmp := packet.NewICMP()
+	defer packet.ReleaseICMP(icmp)
+
+	if e := packet.ParseICMP(ip.Payload, icmp); e != nil {
+		log.Printf("error to parse ICMP: %s", e)
+		return
+	}
+	// errors and neighbor discovery stay inside the tun
+	if (ip.Version == 4 && icmp.Type != packet.ICMPv4TypeEchoRequest) || (ip.Version == 6 && icmp.Type != packet.ICMPv6TypeEchoRequest) {
+		return
+	}
+
+	msg := make([]byte, len(ip.Payload))
+	copy(msg, ip.Payload)
+	track := t2s.getIcmpEchoTrack(icmpEchoID(ip, icmp), ip, icmp)
+	track.newPacket(msg)
+}
+
+func (it *icmpEchoTrack) run() {
+	defer sentry.Recover()
+	defer func() {
+		it.t2s.clearIcmpEchoTrack(it.id)
+		close(it.quitBySelf)
+	}()
+
+	proto := packet.IPProtocolICMPv4
+	if it.localIP.To4() == nil {
+		proto = packet.IPProtocolICMPv6
+	}
+	// proxies can't carry icmp, proxied destinations are pinged directly
+	action, _ := it.t2s.route(&RouteRequest{
+		Uid:      -1,
+		Hostname: it.t2s.lookupHostname(it.remoteIP),
+		DstIP:    it.remoteIP,
+		Protocol: proto,
+	})
+	if action == ROUTE_REJECT {
+		return
+	}
+
+	targetIp, e := it.t2s.realIp(it.remoteIP)
+	if e != nil {
+		log.Printf("fail to resolve fake ip: %s", e)
+		return
+	}
+	conn, e := listenPing(proto == packet.IPProtocolICMPv6)
+	if e != nil {
+		log.Printf("error opening ping socket: %s", e)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(ICMP_ECHO_TIMEOUT))
+
+	// replies are read until the socket goes idle
+	idle := make(chan bool)
+	go func() {
+		defer sentry.Recover()
+		defer close(idle)
+		buf := make([]byte, MTU-packet.HeaderLen)
+		for {
+			n, _, e := conn.ReadFrom(buf)
+			if e != nil || it.t2s.stopped {
+				return
+			}
+			it.reply(buf[:n])
+		}
+	}()
+
+	target := &net.UDPAddr{IP: targetIp}
+	for {
+		select {
+		case msg := <-it.fromTunCh:
+			conn.SetReadDeadline(time.Now().Add(ICMP_ECHO_TIMEOUT))
+			if _, e := conn.WriteTo(msg, target); e != nil {
+				log.Printf("error to send echo request: %s", e)
+				return
+			}
+		case <-idle:
+			return
+		case <-it.quitByOther:
+			return
+		}
+	}
+}
+
+// reply writes an echo reply from the ping socket to the tun
+func (it *icmpEchoTrack) reply(msg []byte) {
+	icmp := packet.NewICMP()
+	defer packet.ReleaseICMP(icmp)
+
+	if e := packet.ParseICMP(msg, icmp); e != nil {
+		return
+	}
+	if icmp.Type != packet.ICMPv4TypeEchoReply && icmp.Type != packet.ICMPv6TypeEchoReply {
+		return
+	}
+	icmp.SetIdSeq(it.echoId, icmp.Seq())
+
+	pkt := icmpPacket(it.remoteIP, it.localIP, icmp, icmp.Payload)
+	if len(pkt.wire) <= it.t2s.mtu {
+		it.t2s.writeCh <- pkt
+		return
+	}
+	for _, frag := range genFragments(pkt.ip, pkt.wire[pkt.ip.HeaderLength():], it.t2s.mtu) {
+		it.t2s.writeCh <- frag
+	}
+	releaseIPPacket(pkt)
+}
+
+func (it *icmpEchoTrack) newPacket(msg []byte) {
+	select {
+	case <-it.quitByOther:
+	case <-it.quitBySelf:
+	case it.fromTunCh <- msg:
+	}
+}
+
+func (t2s *Tun2Socks) clearIcmpEchoTrack(id string) {
+	t2s.icmpEchoTrackLock.Lock()
+	defer t2s.icmpEchoTrackLock.Unlock()
+	delete(t2s.icmpEchoTrackMap, id)
+}
+
+func (t2s *Tun2Socks) getIcmpEchoTrack(id string, ip *packet.Ip, icmp *packet.ICMP) *icmpEchoTrack {
+	t2s.icmpEchoTrackLock.Lock()
+	defer t2s.icmpEchoTrackLock.Unlock()
+
+	track := t2s.icmpEchoTrackMap[id]
+	if track != nil {
+		return track
+	}
+
+	track = &icmpEchoTrack{
+		t2s:         t2s,
+		id:          id,
+		fromTunCh:   make(chan []byte, 100),
+		quitBySelf:  make(chan bool),
+		quitByOther: make(chan bool),
+		echoId:      icmp.Id(),
+	}
+	track.localIP = make(net.IP, len(ip.Src))
+	copy(track.localIP, ip.Src)
+	track.remoteIP = make(net.IP, len(ip.Dst))
+	copy(track.remoteIP, ip.Dst)
+
+	t2s.icmpEchoTrackMap[id] = track
+	go track.run()
+	return track
+}
@@ -12,56 +12,45 @@ type ipPacket struct {
 	wire   []byte
 }
 
-var (
-	frags = make(map[uint16]*ipPacket)
-)
-
-func procFragment(ip *packet.Ip, raw []byte) (bool, *packet.Ip, []byte) {
-	if ip.Version == 6 { //skip for v6 yet
-		return true, ip, ip.Payload
-	}
-
-	exist, ok := frags[ip.V4.Id]
-	if !ok {
-		if ip.V4.Flags&0x1 == 0 {
-			return false, nil, nil
-		}
-		// first
-		dup := make([]byte, len(raw))
-		copy(dup, raw)
-		clone := &packet.Ip{}
-		packet.ParseIp(dup, clone)
-		frags[ip.V4.Id] = &ipPacket{
-			ip:   clone,
-			wire: dup,
-		}
-		return false, clone, dup
-	} else {
-		exist.wire = append(exist.wire, ip.Payload...)
-		packet.ParseIp(exist.wire, exist.ip)
+// genFragments splits a transport segment into packets of at most mtu bytes,
+// IPv4 fragments carry the MF flag and offset, IPv6 ones a Fragment header
+func genFragments(first *packet.Ip, data []byte, mtu int) []*ipPacket {
+	var ret []*ipPacket
 
-		last := false
-		if ip.V4.Flags&0x1 == 0 {
-			last = true
+	var v6Frag *packet.IPv6Fragment
+	fragL := mtu - first.HeaderLength()
+	if first.Version == 6 {
+		v6Frag = &packet.IPv6Fragment{
+			NextHeader: first.GetNextProto(),
+			Id:         packet.IPv6FragmentId(),
 		}
-
-		return last, exist.ip, exist.wire
+		fragL -= packet.IPv6_FRAGMENT_LENGTH
 	}
-}
+	// offsets count in 8 byte units
+	fragL &^= 7
 
-func genFragments(first *packet.Ip, offset uint16, data []byte) []*ipPacket {
-	var ret []*ipPacket
+	for offset := 0; offset < len(data); offset += fragL {
+		end := offset + fragL
+		if end > len(data) {
+			end = len(data)
+		}
+		more := end < len(data)
 
-	for {
 		var frag *packet.Ip
 		if first.Version == 4 {
 			frag = packet.NewIP4()
 			frag.V4.Id = first.V4.Id
 			frag.V4.TTL = first.V4.TTL
 			frag.V4.Protocol = first.V4.Protocol
-			frag.V4.FragOffset = offset
+			frag.V4.FragOffset = uint16(offset / 8)
+			if more {
+				frag.V4.Flags = 1
+			}
 		} else {
 			frag = packet.NewIP6()
+			frag.V6.HopLimit = first.V6.HopLimit
+			frag.SetNextProto(first.GetNextProto())
+			frag.V6.NextHeader = packet.IPProtocolIPv6Fragment
 		}
 
 		frag.Src = make(net.IP, len(first.Src))
@@ -69,39 +58,26 @@ func genFragments(first *packet.Ip, offset uint16, data []byte) []*ipPacket {
 		frag.Dst = make(net.IP, len(first.Dst))
 		copy(frag.Dst, first.Dst)
 
-		if len(data) <= MTU-20 {
-			frag.Payload = data
-		} else {
-			if frag.Version == 4 {
-				frag.V4.Flags = 1
-			}
-			offset += (MTU - 20) / 8
-			frag.Payload = data[:MTU-20]
-			data = data[MTU-20:]
-		}
-
 		pkt := &ipPacket{ip: frag}
 		pkt.mtuBuf = newBuffer()
 
-		payloadL := len(frag.Payload)
+		payloadL := end - offset
 		payloadStart := MTU - payloadL
-		if payloadL != 0 {
-			copy(pkt.mtuBuf[payloadStart:], frag.Payload)
+		copy(pkt.mtuBuf[payloadStart:], data[offset:end])
+		hdrEnd := payloadStart
+		if v6Frag != nil {
+			v6Frag.Offset = offset
+			v6Frag.More = more
+			hdrEnd -= packet.IPv6_FRAGMENT_LENGTH
+			v6Frag.Serialize(pkt.mtuBuf[hdrEnd:payloadStart])
 		}
 		ipHL := frag.HeaderLength()
-		ipStart := payloadStart - ipHL
-		frag.Serialize(pkt.mtuBuf[ipStart:payloadStart], payloadL)
+		ipStart := hdrEnd - ipHL
+		frag.Serialize(pkt.mtuBuf[ipStart:hdrEnd], MTU-hdrEnd)
 		pkt.wire = pkt.mtuBuf[ipStart:]
 		ret = append(ret, pkt)
-
-		if frag.Version == 4 {
-			if frag.V4.Flags == 0 {
-				return ret
-			}
-		} else {
-			return ret
-		}
 	}
+	return ret
 }
 
 func releaseIPPacket(pkt *ipPacket) {
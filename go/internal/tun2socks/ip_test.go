@@ -0,0 +1,67 @@
+package tun2socks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+func TestFragmentsReassemble(t *testing.T) {
+	const mtu = 1003
+	payload := testDatagram(3000)
+	for _, c := range []struct {
+		local, remote net.IP
+		// fragment payload, mtu less the headers rounded down to 8 bytes
+		fragL int
+	}{
+		{net.IPv4(10, 0, 0, 4).To4(), net.IPv4(192, 0, 2, 1).To4(), (mtu - 20) &^ 7},
+		{net.ParseIP("fd00::4"), net.ParseIP("2001:db8::1"), (mtu - 40 - 8) &^ 7},
+	} {
+		pkt, frags := responsePacket(c.local, c.remote, 40000, 53, payload, mtu)
+		if pkt != nil || len(frags) < 2 {
+			t.Fatalf("%s: %d fragments", c.remote, len(frags))
+		}
+
+		r := newReassembler()
+		var datagram []byte
+		// fed backwards, the last fragment first
+		for i := len(frags) - 1; i >= 0; i-- {
+			wire := frags[i].wire
+			if len(wire) > mtu {
+				t.Errorf("%s: fragment %d is %d bytes", c.remote, i, len(wire))
+			}
+			ip := parseWire(t, wire)
+			if c.remote.To4() != nil {
+				if more := ip.V4.Flags&0x1 != 0; more != (i < len(frags)-1) || int(ip.V4.FragOffset)*8 != i*c.fragL {
+					t.Errorf("%s: fragment %d flags %d offset %d", c.remote, i, ip.V4.Flags, ip.V4.FragOffset)
+				}
+				datagram = r.addIPv4(ip, wire)
+			} else {
+				if frag := ip.V6.Fragment; frag == nil || frag.More != (i < len(frags)-1) || frag.Offset != i*c.fragL {
+					t.Errorf("%s: fragment %d header %+v", c.remote, i, frag)
+				}
+				datagram = r.addIPv6(ip, wire)
+			}
+			if i < len(frags)-1 && len(ip.Payload) != c.fragL {
+				t.Errorf("%s: fragment %d carries %d bytes", c.remote, i, len(ip.Payload))
+			}
+		}
+		if datagram == nil {
+			t.Fatalf("%s: not reassembled", c.remote)
+		}
+
+		ip := parseWire(t, datagram)
+		udp := &packet.UDP{}
+		if e := packet.ParseUDP(ip.Payload, udp); e != nil {
+			t.Fatal(e)
+		}
+		if !ip.Src.Equal(c.remote) || udp.SrcPort != 53 || udp.DstPort != 40000 || !bytes.Equal(udp.Payload, payload) {
+			t.Errorf("%s: reassembled %s:%d -> %d, %d bytes", c.remote, ip.Src, udp.SrcPort, udp.DstPort, len(udp.Payload))
+		}
+		for _, frag := range frags {
+			releaseIPPacket(frag)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package tun2socks
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ALL_UIDS = -1
+)
+
+// DnsPolicy holds the filtering configuration of the dns forwarder, it can be
+// changed while the engine runs
+type DnsPolicy struct {
+	lock       sync.RWMutex
+	blocklists map[int]*Blocklist
+	safeSearch map[int]bool
+	bypass     *DnsBypassList
+	hosts      *HostsTable
+}
+
+func NewDnsPolicy() *DnsPolicy {
+	return &DnsPolicy{
+		blocklists: make(map[int]*Blocklist),
+		safeSearch: make(map[int]bool),
+	}
+}
+
+// SetBlocklist replaces the list of an app, ALL_UIDS applies to every app.
+// nil removes the list.
+func (p *DnsPolicy) SetBlocklist(uid int, list *Blocklist) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if list == nil {
+		delete(p.blocklists, uid)
+	} else {
+		p.blocklists[uid] = list
+	}
+}
+
+func (p *DnsPolicy) ClearBlocklists() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.blocklists = make(map[int]*Blocklist)
+}
+
+// SetSafeSearch turns SafeSearch and YouTube restricted mode on or off for an
+// app, ALL_UIDS applies to every app
+func (p *DnsPolicy) SetSafeSearch(uid int, enabled bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if enabled {
+		p.safeSearch[uid] = true
+	} else {
+		delete(p.safeSearch, uid)
+	}
+}
+
+func (p *DnsPolicy) ClearSafeSearch() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.safeSearch = make(map[int]bool)
+}
+
+// SetBypassList sets the encrypted dns resolvers that are rejected so apps
+// fall back to the engine's resolver, nil allows them
+func (p *DnsPolicy) SetBypassList(list *DnsBypassList) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.bypass = list
+}
+
+func (p *DnsPolicy) bypassList() *DnsBypassList {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.bypass
+}
+
+// SetHosts sets the static name to address table answered before any
+// other policy, nil removes it
+func (p *DnsPolicy) SetHosts(hosts *HostsTable) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.hosts = hosts
+}
+
+func (p *DnsPolicy) hostsAnswer(q *dnsQuery) *dns.Msg {
+	p.lock.RLock()
+	hosts := p.hosts
+	p.lock.RUnlock()
+	if hosts == nil {
+		return nil
+	}
+	return hosts.answer(q.msg)
+}
+
+// blocked returns the list blocking the domain for the app, the app's own
+// list is checked before the one for all apps
+func (p *DnsPolicy) blocked(uid int, domain string) *Blocklist {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, id := range []int{uid, ALL_UIDS} {
+		if list, ok := p.blocklists[id]; ok && list.Contains(domain) {
+			return list
+		}
+		if uid == ALL_UIDS {
+			break
+		}
+	}
+	return nil
+}
+
+// apply answers queries the policy decides on, nil to resolve normally
+func (p *DnsPolicy) apply(q *dnsQuery) *dns.Msg {
+	p.lock.RLock()
+	empty := len(p.blocklists) == 0
+	p.lock.RUnlock()
+	if empty {
+		return nil
+	}
+
+	domain := strings.TrimSuffix(q.msg.Question[0].Name, ".")
+	if list := p.blocked(q.Uid(), domain); list != nil {
+		return list.answer(q.msg)
+	}
+	return nil
+}
+
+// safeSearchTarget returns the restricted host the query is rewritten to,
+// empty if SafeSearch is off for the app or the domain isn't covered
+func (p *DnsPolicy) safeSearchTarget(q *dnsQuery) string {
+	p.lock.RLock()
+	empty := len(p.safeSearch) == 0
+	p.lock.RUnlock()
+	if empty {
+		return ""
+	}
+
+	target := safeSearchHost(q.msg.Question[0].Name)
+	if len(target) == 0 {
+		return ""
+	}
+
+	uid := q.Uid()
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.safeSearch[uid] || p.safeSearch[ALL_UIDS] {
+		return target
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package tun2socks
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DNS_LOG_SIZE = 1000
+)
+
+// DnsLogEntry is one query answered by the dns forwarder
+type DnsLogEntry struct {
+	Seq     int64    `json:"seq"`
+	Time    int64    `json:"time"` // unix milliseconds
+	Uid     int      `json:"uid"`
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Rcode   string   `json:"rcode"`
+	Answers []string `json:"answers"`
+	Altered bool     `json:"altered"` // answered by policy, not by the upstream
+}
+
+type DnsLogCallback interface {
+	OnDnsQuery(entry *DnsLogEntry)
+}
+
+// DnsLog keeps the latest queries in a ring buffer and hands each one to an
+// optional callback
+type DnsLog struct {
+	lock     sync.Mutex
+	entries  []*DnsLogEntry
+	next     int
+	seq      int64
+	callback DnsLogCallback
+}
+
+func NewDnsLog(size int) *DnsLog {
+	if size <= 0 {
+		size = DNS_LOG_SIZE
+	}
+	return &DnsLog{
+		entries: make([]*DnsLogEntry, size),
+	}
+}
+
+func (l *DnsLog) SetCallback(callback DnsLogCallback) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.callback = callback
+}
+
+func (l *DnsLog) add(entry *DnsLogEntry) {
+	l.lock.Lock()
+	l.seq++
+	entry.Seq = l.seq
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	callback := l.callback
+	l.lock.Unlock()
+
+	if callback != nil {
+		callback.OnDnsQuery(entry)
+	}
+}
+
+// Entries returns the buffered entries newer than seq, oldest first
+func (l *DnsLog) Entries(since int64) []*DnsLogEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var ret []*DnsLogEntry
+	for i := 0; i < len(l.entries); i++ {
+		entry := l.entries[(l.next+i)%len(l.entries)]
+		if entry != nil && entry.Seq > since {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+func (l *DnsLog) Clear() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := range l.entries {
+		l.entries[i] = nil
+	}
+	l.next = 0
+}
+
+// record logs an answered query if the log is on
+func (d *dnsServer) record(q *dnsQuery, resp *dns.Msg) {
+	dnsLog := d.t2s.dnsLog
+	if dnsLog == nil {
+		return
+	}
+
+	question := q.msg.Question[0]
+	entry := &DnsLogEntry{
+		Time:    time.Now().UnixNano() / int64(time.Millisecond),
+		Uid:     q.Uid(),
+		Name:    normalizeDomain(question.Name),
+		Type:    dns.Type(question.Qtype).String(),
+		Rcode:   dns.RcodeToString[resp.Rcode],
+		Altered: q.altered,
+	}
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			entry.Answers = append(entry.Answers, rr.A.String())
+		case *dns.AAAA:
+			entry.Answers = append(entry.Answers, rr.AAAA.String())
+		}
+	}
+	dnsLog.add(entry)
+}
@@ -0,0 +1,296 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+const (
+	FRAG_TIMEOUT       = 30 * time.Second
+	FRAG_MEMORY_BUDGET = 4 << 20
+	FRAG_MAX_DATAGRAM  = 65535
+)
+
+type fragKey struct {
+	src   [16]byte
+	dst   [16]byte
+	proto packet.IPProtocol
+	id    uint32
+}
+
+type fragRange struct {
+	start int
+	end   int
+}
+
+// fragBuffer collects the fragments of one datagram, ranges lists the bytes
+// received so far, sorted and merged
+type fragBuffer struct {
+	header  []byte
+	data    []byte
+	ranges  []fragRange
+	total   int
+	expires time.Time
+}
+
+func (b *fragBuffer) memory() int {
+	return cap(b.data) + len(b.header)
+}
+
+// insert copies a fragment into the gaps it covers, bytes already received
+// win over overlapping ones
+func (b *fragBuffer) insert(offset int, payload []byte) {
+	end := offset + len(payload)
+	if end > len(b.data) {
+		grown := make([]byte, end)
+		copy(grown, b.data)
+		b.data = grown
+	}
+
+	pos := offset
+	for _, r := range b.ranges {
+		if r.end <= pos {
+			continue
+		}
+		if r.start >= end {
+			break
+		}
+		if r.start > pos {
+			copy(b.data[pos:r.start], payload[pos-offset:])
+		}
+		pos = r.end
+	}
+	if pos < end {
+		copy(b.data[pos:end], payload[pos-offset:])
+	}
+
+	// merge the new range
+	merged := make([]fragRange, 0, len(b.ranges)+1)
+	added := fragRange{start: offset, end: end}
+	placed := false
+	for _, r := range b.ranges {
+		switch {
+		case r.end < added.start:
+			merged = append(merged, r)
+		case r.start > added.end:
+			if !placed {
+				merged = append(merged, added)
+				placed = true
+			}
+			merged = append(merged, r)
+		default:
+			if r.start < added.start {
+				added.start = r.start
+			}
+			if r.end > added.end {
+				added.end = r.end
+			}
+		}
+	}
+	if !placed {
+		merged = append(merged, added)
+	}
+	b.ranges = merged
+}
+
+// overlaps reports whether any byte from offset to end was received already
+func (b *fragBuffer) overlaps(offset int, end int) bool {
+	for _, r := range b.ranges {
+		if r.start < end && offset < r.end {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *fragBuffer) complete() bool {
+	return b.header != nil && b.total >= 0 && len(b.ranges) == 1 && b.ranges[0].start == 0 && b.ranges[0].end == b.total
+}
+
+// reassembler rebuilds fragmented datagrams read from the tun. Incomplete
+// datagrams expire after FRAG_TIMEOUT, the oldest are dropped when the held
+// fragments exceed FRAG_MEMORY_BUDGET.
+type reassembler struct {
+	lock      sync.Mutex
+	buffers   map[fragKey]*fragBuffer
+	memory    int
+	lastSweep time.Time
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{
+		buffers: make(map[fragKey]*fragBuffer),
+	}
+}
+
+// addIPv4 stores a fragment, raw is the whole packet. Returns the rebuilt
+// packet once all fragments arrived, nil otherwise.
+func (r *reassembler) addIPv4(ip *packet.Ip, raw []byte) []byte {
+	headerLen := int(ip.V4.IHL) * 4
+	if int(ip.V4.Length) > len(raw) || int(ip.V4.Length) < headerLen {
+		return nil
+	}
+	payload := raw[headerLen:ip.V4.Length]
+	offset := int(ip.V4.FragOffset) * 8
+	more := ip.V4.Flags&0x1 != 0
+
+	var key fragKey
+	copy(key.src[:], ip.Src)
+	copy(key.dst[:], ip.Dst)
+	key.proto = ip.V4.Protocol
+	key.id = uint32(ip.V4.Id)
+
+	var header []byte
+	if offset == 0 {
+		header = raw[:headerLen]
+	}
+	data, header := r.add(key, offset, payload, more, header, false)
+	if data == nil {
+		return nil
+	}
+
+	// first fragment's header with the fragment fields cleared
+	datagram := make([]byte, len(header)+len(data))
+	copy(datagram, header)
+	copy(datagram[len(header):], data)
+	binary.BigEndian.PutUint16(datagram[2:], uint16(len(datagram)))
+	binary.BigEndian.PutUint16(datagram[6:], binary.BigEndian.Uint16(datagram[6:])&0x4000)
+	datagram[10] = 0
+	datagram[11] = 0
+	binary.BigEndian.PutUint16(datagram[10:], packet.Checksum(datagram[:len(header)]))
+	return datagram
+}
+
+// addIPv6 is addIPv4 for packets with a Fragment header
+func (r *reassembler) addIPv6(ip *packet.Ip, raw []byte) []byte {
+	frag := ip.V6.Fragment
+	end := len(raw)
+	if packet.HeaderLen+int(ip.V6.PayloadLen) < end {
+		end = packet.HeaderLen + int(ip.V6.PayloadLen)
+	}
+	if frag.HeaderStart+8 > end {
+		return nil
+	}
+	payload := raw[frag.HeaderStart+8 : end]
+
+	var key fragKey
+	copy(key.src[:], ip.Src)
+	copy(key.dst[:], ip.Dst)
+	key.proto = frag.NextHeader
+	key.id = frag.Id
+
+	var header []byte
+	if frag.Offset == 0 {
+		header = frag.Unfragmentable(raw)
+	}
+	// RFC 5722, overlapping fragments drop the whole datagram
+	data, header := r.add(key, frag.Offset, payload, frag.More, header, true)
+	if data == nil {
+		return nil
+	}
+
+	datagram := make([]byte, len(header)+len(data))
+	copy(datagram, header)
+	copy(datagram[len(header):], data)
+	binary.BigEndian.PutUint16(datagram[4:], uint16(len(datagram)-packet.HeaderLen))
+	return datagram
+}
+
+// add files a fragment under key, header is set for the first fragment. Once
+// the datagram is complete its payload and first header are returned. With
+// dropOverlap a fragment overlapping received bytes discards the datagram,
+// otherwise the bytes received first win.
+func (r *reassembler) add(key fragKey, offset int, payload []byte, more bool, header []byte, dropOverlap bool) ([]byte, []byte) {
+	end := offset + len(payload)
+	if (more && len(payload)%8 != 0) || len(header)+end > FRAG_MAX_DATAGRAM {
+		return nil, nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastSweep) > time.Second {
+		r.sweep(now)
+	}
+
+	b, ok := r.buffers[key]
+	if !ok {
+		b = &fragBuffer{
+			total:   -1,
+			expires: now.Add(FRAG_TIMEOUT),
+		}
+		r.buffers[key] = b
+	}
+	before := b.memory()
+
+	if dropOverlap && b.overlaps(offset, end) {
+		log.Printf("Overlapping fragments, dropping datagram %d", key.id)
+		r.drop(key, b)
+		return nil, nil
+	}
+	if !more {
+		if (b.total >= 0 && b.total != end) || (len(b.ranges) > 0 && b.ranges[len(b.ranges)-1].end > end) {
+			// conflicting lengths, the datagram can't be rebuilt
+			r.drop(key, b)
+			return nil, nil
+		}
+		b.total = end
+	} else if b.total >= 0 && end > b.total {
+		r.drop(key, b)
+		return nil, nil
+	}
+	if header != nil && b.header == nil {
+		b.header = make([]byte, len(header))
+		copy(b.header, header)
+	}
+	b.insert(offset, payload)
+	r.memory += b.memory() - before
+
+	if b.complete() {
+		r.drop(key, b)
+		return b.data[:b.total], b.header
+	}
+
+	for r.memory > FRAG_MEMORY_BUDGET {
+		if !r.dropOldest() {
+			break
+		}
+	}
+	return nil, nil
+}
+
+func (r *reassembler) drop(key fragKey, b *fragBuffer) {
+	r.memory -= b.memory()
+	delete(r.buffers, key)
+}
+
+func (r *reassembler) dropOldest() bool {
+	var oldestKey fragKey
+	var oldest *fragBuffer
+	for key, b := range r.buffers {
+		if oldest == nil || b.expires.Before(oldest.expires) {
+			oldestKey = key
+			oldest = b
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	log.Printf("Fragment memory budget exceeded, dropping datagram %d", oldestKey.id)
+	r.drop(oldestKey, oldest)
+	return true
+}
+
+func (r *reassembler) sweep(now time.Time) {
+	r.lastSweep = now
+	for key, b := range r.buffers {
+		if now.After(b.expires) {
+			r.drop(key, b)
+		}
+	}
+}
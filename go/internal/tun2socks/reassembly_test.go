@@ -0,0 +1,204 @@
+package tun2socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+// fragment4 builds an IPv4 fragment of a udp datagram from 10.0.0.4 to
+// 192.0.2.1 carrying data at offset
+func fragment4(id uint16, offset int, data []byte, more bool) []byte {
+	raw := make([]byte, 20+len(data))
+	raw[0] = 0x45
+	binary.BigEndian.PutUint16(raw[2:], uint16(len(raw)))
+	binary.BigEndian.PutUint16(raw[4:], id)
+	flags := uint16(offset / 8)
+	if more {
+		flags |= 0x2000
+	}
+	binary.BigEndian.PutUint16(raw[6:], flags)
+	raw[8] = 64
+	raw[9] = byte(packet.IPProtocolUDP)
+	copy(raw[12:], []byte{10, 0, 0, 4})
+	copy(raw[16:], []byte{192, 0, 2, 1})
+	binary.BigEndian.PutUint16(raw[10:], packet.Checksum(raw[:20]))
+	copy(raw[20:], data)
+	return raw
+}
+
+func (r *reassembler) addTest(t *testing.T, raw []byte) []byte {
+	return r.addIPv4(parseWire(t, raw), raw)
+}
+
+func testDatagram(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestReassembleIPv4(t *testing.T) {
+	data := testDatagram(64)
+	type frag struct {
+		start, end int
+	}
+	for _, c := range []struct {
+		name  string
+		frags []frag
+	}{
+		{"in order", []frag{{0, 24}, {24, 48}, {48, 64}}},
+		{"out of order", []frag{{48, 64}, {24, 48}, {0, 24}}},
+		{"overlapping", []frag{{0, 32}, {24, 56}, {48, 64}}},
+		{"duplicate", []frag{{0, 24}, {0, 24}, {24, 48}, {24, 48}, {48, 64}}},
+	} {
+		r := newReassembler()
+		var datagram []byte
+		for i, f := range c.frags {
+			datagram = r.addTest(t, fragment4(1, f.start, data[f.start:f.end], f.end != len(data)))
+			if datagram != nil && i != len(c.frags)-1 {
+				t.Fatalf("%s: rebuilt after %d fragments", c.name, i+1)
+			}
+		}
+		if datagram == nil {
+			t.Fatalf("%s: not rebuilt", c.name)
+		}
+		ip := parseWire(t, datagram)
+		if !bytes.Equal(ip.Payload, data) {
+			t.Errorf("%s: payload %v", c.name, ip.Payload)
+		}
+		if ip.V4.Flags&0x1 != 0 || ip.V4.FragOffset != 0 || int(ip.V4.Length) != 20+len(data) {
+			t.Errorf("%s: header flags %d offset %d length %d", c.name, ip.V4.Flags, ip.V4.FragOffset, ip.V4.Length)
+		}
+		if packet.Checksum(datagram[:20]) != 0 {
+			t.Errorf("%s: bad header checksum", c.name)
+		}
+		if len(r.buffers) != 0 || r.memory != 0 {
+			t.Errorf("%s: %d buffers, %d bytes held", c.name, len(r.buffers), r.memory)
+		}
+	}
+}
+
+func TestReassembleRejectsMalformed(t *testing.T) {
+	r := newReassembler()
+	// ends past the largest datagram
+	if r.addTest(t, fragment4(1, 65528, testDatagram(16), false)) != nil {
+		t.Error("datagram over 65535 bytes rebuilt")
+	}
+	// a fragment followed by another has to end on an 8 byte boundary
+	if r.addTest(t, fragment4(2, 0, testDatagram(20), true)) != nil {
+		t.Error("unaligned fragment accepted")
+	}
+	if len(r.buffers) != 0 || r.memory != 0 {
+		t.Errorf("%d buffers, %d bytes held", len(r.buffers), r.memory)
+	}
+}
+
+func TestReassembleExpires(t *testing.T) {
+	r := newReassembler()
+	data := testDatagram(32)
+	r.addTest(t, fragment4(1, 0, data[:16], true))
+	for _, b := range r.buffers {
+		b.expires = time.Now().Add(-time.Millisecond)
+	}
+	r.lastSweep = time.Now().Add(-FRAG_TIMEOUT)
+
+	// the sweep runs on the next fragment
+	if r.addTest(t, fragment4(1, 16, data[16:], false)) != nil {
+		t.Error("rebuilt from an expired fragment")
+	}
+	// only the last fragment is held
+	for _, b := range r.buffers {
+		if b.header != nil || len(b.ranges) != 1 || b.ranges[0].start != 16 {
+			t.Errorf("expired fragment kept: %v", b.ranges)
+		}
+	}
+	if len(r.buffers) != 1 {
+		t.Errorf("%d buffers held", len(r.buffers))
+	}
+}
+
+func TestReassembleMemoryBudget(t *testing.T) {
+	r := newReassembler()
+	data := testDatagram(60000)
+	count := FRAG_MEMORY_BUDGET/len(data) + 8
+	for id := 1; id <= count; id++ {
+		r.addTest(t, fragment4(uint16(id), 0, data, true))
+	}
+	if r.memory > FRAG_MEMORY_BUDGET {
+		t.Errorf("%d bytes held over the budget", r.memory)
+	}
+	held := map[uint32]bool{}
+	for key := range r.buffers {
+		held[key.id] = true
+	}
+	if held[1] || !held[uint32(count)] {
+		t.Errorf("the oldest datagrams weren't the ones dropped: %v", held)
+	}
+
+	// a dropped datagram can't complete anymore
+	if r.addTest(t, fragment4(1, len(data), data[:8], false)) != nil {
+		t.Error("dropped datagram rebuilt")
+	}
+}
+
+// fragment6 builds an IPv6 fragment of a udp datagram from fd00::4 to
+// fd00::1, a hop-by-hop header stays in front of the Fragment header
+func fragment6(id uint32, offset int, data []byte, more bool) []byte {
+	raw := make([]byte, packet.HeaderLen+16+len(data))
+	raw[0] = 6 << 4
+	binary.BigEndian.PutUint16(raw[4:], uint16(len(raw)-packet.HeaderLen))
+	raw[6] = byte(packet.IPProtocolIPv6HopByHop)
+	raw[7] = 64
+	raw[8], raw[23] = 0xfd, 4
+	raw[24], raw[39] = 0xfd, 1
+	raw[packet.HeaderLen] = byte(packet.IPProtocolIPv6Fragment)
+	frag := &packet.IPv6Fragment{NextHeader: packet.IPProtocolUDP, Offset: offset, More: more, Id: id}
+	frag.Serialize(raw[packet.HeaderLen+8 : packet.HeaderLen+16])
+	copy(raw[packet.HeaderLen+16:], data)
+	return raw
+}
+
+func (r *reassembler) addTest6(t *testing.T, raw []byte) []byte {
+	return r.addIPv6(parseWire(t, raw), raw)
+}
+
+func TestReassembleIPv6(t *testing.T) {
+	data := testDatagram(64)
+	r := newReassembler()
+	for _, f := range [][2]int{{48, 64}, {0, 24}, {24, 48}} {
+		if datagram := r.addTest6(t, fragment6(1, f[0], data[f[0]:f[1]], f[1] != len(data))); datagram != nil {
+			ip := parseWire(t, datagram)
+			if ip.V6.Fragment != nil || ip.GetNextProto() != packet.IPProtocolUDP || !bytes.Equal(ip.Payload, data) {
+				t.Errorf("fragment %v protocol %d payload %v", ip.V6.Fragment, ip.GetNextProto(), ip.Payload)
+			}
+			if int(ip.V6.PayloadLen) != 8+len(data) {
+				t.Errorf("payload length %d", ip.V6.PayloadLen)
+			}
+			return
+		}
+	}
+	t.Fatal("not rebuilt")
+}
+
+func TestReassembleIPv6DropsOverlaps(t *testing.T) {
+	data := testDatagram(64)
+	for _, overlap := range [][2]int{{24, 56}, {0, 32}} {
+		r := newReassembler()
+		r.addTest6(t, fragment6(1, 0, data[:32], true))
+		if r.addTest6(t, fragment6(1, overlap[0], data[overlap[0]:overlap[1]], true)) != nil {
+			t.Fatal("rebuilt from overlapping fragments")
+		}
+		if len(r.buffers) != 0 || r.memory != 0 {
+			t.Errorf("overlap %v kept %d buffers, %d bytes", overlap, len(r.buffers), r.memory)
+		}
+		// the rest can't complete the discarded datagram
+		if r.addTest6(t, fragment6(1, 32, data[32:], false)) != nil {
+			t.Errorf("overlap %v: rebuilt after the drop", overlap)
+		}
+	}
+}
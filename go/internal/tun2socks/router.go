@@ -0,0 +1,289 @@
+package tun2socks
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+const (
+	ROUTE_DEFAULT = 0 // no rule matched, per uid proxy for http(s) ports
+	ROUTE_PROXY   = 1
+	ROUTE_DIRECT  = 2
+	ROUTE_REJECT  = 3
+)
+
+var (
+	directProxyServer = &ProxyServer{
+		ProxyType: PROXY_TYPE_NONE,
+		IpAddress: ":",
+	}
+)
+
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// RoutingRule matches when every non empty condition matches. Domain
+// conditions never match flows with unknown hostname.
+type RoutingRule struct {
+	DomainSuffixes []string
+	DomainKeywords []string
+	Networks       []*net.IPNet
+	Ports          []PortRange
+	Uids           []int
+	Protocol       packet.IPProtocol // 0 matches any
+
+	Action int
+	// proxy registered in the router, empty for the app's proxy
+	ProxyName string
+}
+
+type RouteRequest struct {
+	Uid      int
+	Hostname string
+	DstIP    net.IP
+	DstPort  uint16
+	Protocol packet.IPProtocol
+}
+
+type Router struct {
+	lock    sync.RWMutex
+	rules   []*RoutingRule
+	proxies map[string]*ProxyServer
+}
+
+func NewRouter() *Router {
+	return &Router{
+		proxies: make(map[string]*ProxyServer),
+	}
+}
+
+// NewRoutingRule builds a rule from comma separated lists, as they come from
+// the java side. Ports may be given as ranges, e.g. "80,8000-8100".
+func NewRoutingRule(action int, proxyName string, domains string, keywords string, cidrs string, ports string, uids string, protocol int) (*RoutingRule, error) {
+	rule := &RoutingRule{
+		Action:    action,
+		ProxyName: proxyName,
+		Protocol:  packet.IPProtocol(protocol),
+	}
+
+	for _, domain := range splitList(domains) {
+		rule.DomainSuffixes = append(rule.DomainSuffixes, strings.TrimSuffix(strings.ToLower(domain), "."))
+	}
+	for _, keyword := range splitList(keywords) {
+		rule.DomainKeywords = append(rule.DomainKeywords, strings.ToLower(keyword))
+	}
+	for _, cidr := range splitList(cidrs) {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		rule.Networks = append(rule.Networks, network)
+	}
+	for _, port := range splitList(ports) {
+		bounds := strings.SplitN(port, "-", 2)
+		from, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if len(bounds) == 2 {
+			to, err = strconv.ParseUint(bounds[1], 10, 16)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if to < from {
+			return nil, fmt.Errorf("Invalid port range %s", port)
+		}
+		rule.Ports = append(rule.Ports, PortRange{uint16(from), uint16(to)})
+	}
+	for _, uid := range splitList(uids) {
+		id, err := strconv.Atoi(uid)
+		if err != nil {
+			return nil, err
+		}
+		rule.Uids = append(rule.Uids, id)
+	}
+
+	return rule, nil
+}
+
+func splitList(list string) []string {
+	var res []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func (r *Router) SetProxy(name string, proxy *ProxyServer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.proxies[name] = proxy
+}
+
+func (r *Router) AddRule(rule *RoutingRule) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rules = append(r.rules, rule)
+}
+
+func (r *Router) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rules = nil
+	r.proxies = make(map[string]*ProxyServer)
+}
+
+// Route returns the action of the first matching rule and the named proxy
+// for ROUTE_PROXY, nil proxy means the app's own proxy
+func (r *Router) Route(req *RouteRequest) (int, *ProxyServer) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	hostname := strings.TrimSuffix(strings.ToLower(req.Hostname), ".")
+	for _, rule := range r.rules {
+		if !rule.match(req, hostname) {
+			continue
+		}
+		if rule.Action == ROUTE_PROXY && len(rule.ProxyName) > 0 {
+			proxy, ok := r.proxies[rule.ProxyName]
+			if !ok {
+				// unknown proxy, treat the rule as not configured yet
+				continue
+			}
+			return rule.Action, proxy
+		}
+		return rule.Action, nil
+	}
+	return ROUTE_DEFAULT, nil
+}
+
+func (rule *RoutingRule) match(req *RouteRequest, hostname string) bool {
+	if rule.Protocol != 0 && rule.Protocol != req.Protocol {
+		return false
+	}
+
+	if len(rule.Uids) > 0 {
+		found := false
+		for _, uid := range rule.Uids {
+			if uid == req.Uid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(rule.Ports) > 0 {
+		found := false
+		for _, ports := range rule.Ports {
+			if req.DstPort >= ports.From && req.DstPort <= ports.To {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(rule.Networks) > 0 {
+		found := false
+		for _, network := range rule.Networks {
+			if network.Contains(req.DstIP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(rule.DomainSuffixes) > 0 || len(rule.DomainKeywords) > 0 {
+		if len(hostname) == 0 {
+			return false
+		}
+		found := false
+		for _, suffix := range rule.DomainSuffixes {
+			if hostname == suffix || strings.HasSuffix(hostname, "."+suffix) {
+				found = true
+				break
+			}
+		}
+		for _, keyword := range rule.DomainKeywords {
+			if found {
+				break
+			}
+			found = strings.Contains(hostname, keyword)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t2s *Tun2Socks) uidProxy(uid int) *ProxyServer {
+	proxyServer, ok := t2s.proxyServerMap[uid]
+	if !ok {
+		return t2s.defaultProxyServer
+	}
+	return proxyServer
+}
+
+// route consults the router and falls back to the legacy behaviour: tcp to
+// 80 and 443 goes to the app's proxy, QUIC is blocked, other udp goes to the
+// app's proxy when it's socks and everything else direct
+func (t2s *Tun2Socks) route(req *RouteRequest) (int, *ProxyServer) {
+	action, proxy := ROUTE_DEFAULT, (*ProxyServer)(nil)
+	if t2s.router != nil {
+		action, proxy = t2s.router.Route(req)
+	}
+
+	switch action {
+	case ROUTE_PROXY:
+		if proxy == nil {
+			proxy = t2s.uidProxy(req.Uid)
+		}
+		return action, proxy
+	case ROUTE_DIRECT, ROUTE_REJECT:
+		return action, directProxyServer
+	}
+
+	isHttpPort := req.DstPort == 80 || req.DstPort == 443
+	if req.Protocol == packet.IPProtocolTCP && isHttpPort && !isPrivate(req.DstIP) {
+		return ROUTE_PROXY, t2s.uidProxy(req.Uid)
+	}
+	if req.Protocol == packet.IPProtocolUDP && isHttpPort {
+		return ROUTE_REJECT, directProxyServer
+	}
+	// only socks can carry udp, other proxies leave it direct
+	if req.Protocol == packet.IPProtocolUDP {
+		if proxy := t2s.uidProxy(req.Uid); proxy != nil && proxy.ProxyType == PROXY_TYPE_SOCKS {
+			return ROUTE_PROXY, proxy
+		}
+	}
+	return ROUTE_DIRECT, directProxyServer
+}
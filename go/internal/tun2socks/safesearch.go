@@ -0,0 +1,100 @@
+package tun2socks
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	SAFESEARCH_GOOGLE     = "forcesafesearch.google.com"
+	SAFESEARCH_BING       = "strict.bing.com"
+	SAFESEARCH_DUCKDUCKGO = "safe.duckduckgo.com"
+	SAFESEARCH_YOUTUBE    = "restrict.youtube.com"
+
+	SAFESEARCH_TTL = 300
+)
+
+// safeSearchHosts maps search and video hosts to their restricted virtual
+// host, google country domains are matched in safeSearchHost
+var safeSearchHosts = map[string]string{
+	"bing.com":                 SAFESEARCH_BING,
+	"www.bing.com":             SAFESEARCH_BING,
+	"duckduckgo.com":           SAFESEARCH_DUCKDUCKGO,
+	"www.duckduckgo.com":       SAFESEARCH_DUCKDUCKGO,
+	"start.duckduckgo.com":     SAFESEARCH_DUCKDUCKGO,
+	"youtube.com":              SAFESEARCH_YOUTUBE,
+	"www.youtube.com":          SAFESEARCH_YOUTUBE,
+	"m.youtube.com":            SAFESEARCH_YOUTUBE,
+	"music.youtube.com":        SAFESEARCH_YOUTUBE,
+	"youtubei.googleapis.com":  SAFESEARCH_YOUTUBE,
+	"youtube.googleapis.com":   SAFESEARCH_YOUTUBE,
+	"youtube-nocookie.com":     SAFESEARCH_YOUTUBE,
+	"www.youtube-nocookie.com": SAFESEARCH_YOUTUBE,
+}
+
+// googleSearchSuffixes are the suffixes after google. of the search domains,
+// from https://www.google.com/supported_domains
+var googleSearchSuffixes = func() map[string]bool {
+	suffixes := make(map[string]bool)
+	for _, suffix := range strings.Fields(`com ad ae com.af com.ag al am co.ao com.ar as at com.au az ba com.bd be bf bg com.bh bi bj com.bn com.bo
+		com.br bs bt co.bw by com.bz ca cat cd cf cg ch ci co.ck cl cm cn com.co co.cr com.cu cv com.cy cz de dj dk dm
+		com.do dz com.ec ee com.eg es com.et fi com.fj fm fr ga ge gg com.gh com.gi gl gm gr com.gt gy com.hk hn hr ht
+		hu co.id ie co.il im co.in iq is it je com.jm jo co.jp co.ke com.kh ki kg co.kr com.kw kz la com.lb li lk co.ls
+		lt lu lv com.ly co.ma md me mg mk ml com.mm mn com.mt mu mv mw com.mx com.my co.mz com.na com.ng com.ni ne nl no
+		com.np nr nu co.nz com.om com.pa com.pe com.pg com.ph com.pk pl pn com.pr ps pt com.py com.qa ro rs ru rw com.sa
+		com.sb sc se com.sg sh si sk com.sl sn so sm sr st com.sv td tg co.th com.tj tl tm tn to com.tr tt com.tw co.tz
+		com.ua co.ug co.uk com.uy co.uz com.vc co.ve co.vi com.vn vu ws co.za co.zm co.zw`) {
+		suffixes[suffix] = true
+	}
+	return suffixes
+}()
+
+// safeSearchHost returns the safe search host replacing domain, empty if the
+// domain isn't a search engine or video site
+func safeSearchHost(domain string) string {
+	domain = normalizeDomain(domain)
+	if target, ok := safeSearchHosts[domain]; ok {
+		return target
+	}
+
+	// google.com, www.google.co.uk, google.com.au and the like
+	name := strings.TrimPrefix(domain, "www.")
+	if strings.HasPrefix(name, "google.") && googleSearchSuffixes[strings.TrimPrefix(name, "google.")] {
+		return SAFESEARCH_GOOGLE
+	}
+	return ""
+}
+
+// safeSearchAnswer points the query to target with a CNAME and adds the
+// records of target
+func (d *dnsServer) safeSearchAnswer(q *dnsQuery, target string) *dns.Msg {
+	question := q.msg.Question[0]
+
+	sub := q.msg.Copy()
+	sub.Question[0].Name = dns.Fqdn(target)
+	targetQuery := &dnsQuery{
+		t2s:      q.t2s,
+		msg:      sub,
+		srcIP:    q.srcIP,
+		dstIP:    q.dstIP,
+		srcPort:  q.srcPort,
+		dstPort:  q.dstPort,
+		uid:      q.uid,
+		uidKnown: q.uidKnown,
+		proxy:    q.proxy,
+	}
+
+	targetResp := d.lookup(targetQuery)
+
+	resp := new(dns.Msg)
+	resp.SetReply(q.msg)
+	resp.RecursionAvailable = true
+	resp.Rcode = targetResp.Rcode
+	resp.Answer = append(resp.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: SAFESEARCH_TTL},
+		Target: dns.Fqdn(target),
+	})
+	resp.Answer = append(resp.Answer, targetResp.Answer...)
+	return resp
+}
@@ -0,0 +1,92 @@
+package tun2socks
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSafeSearchHost(t *testing.T) {
+	for domain, want := range map[string]string{
+		"google.com":                 SAFESEARCH_GOOGLE,
+		"www.google.co.uk.":          SAFESEARCH_GOOGLE,
+		"www.google.com.au":          SAFESEARCH_GOOGLE,
+		"WWW.Google.DE":              SAFESEARCH_GOOGLE,
+		"google.cat":                 SAFESEARCH_GOOGLE,
+		"google.dev":                 "",
+		"google.org":                 "",
+		"www.google.xyz":             "",
+		"google.co.evil":             "",
+		"mail.google.com":            "",
+		"www.bing.com":               SAFESEARCH_BING,
+		"m.youtube.com":              SAFESEARCH_YOUTUBE,
+		"notyoutube.com":             "",
+		"duckduckgo.com":             SAFESEARCH_DUCKDUCKGO,
+		"forcesafesearch.google.com": "",
+	} {
+		if got := safeSearchHost(domain); got != want {
+			t.Errorf("safeSearchHost(%q) = %q, want %q", domain, got, want)
+		}
+	}
+}
+
+func TestSafeSearchTargetResolvedThroughAppProxy(t *testing.T) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	seen := make(chan string, 1)
+	server := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		seen <- req.Question[0].Name
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 216.239.38.120")
+		resp.Answer = append(resp.Answer, rr)
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	proxyLn, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer proxyLn.Close()
+	go serveSocks(proxyLn)
+
+	t2s := newTestEngine()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: proxyLn.Addr().String()})
+	policy := NewDnsPolicy()
+	policy.SetSafeSearch(ALL_UIDS, true)
+	t2s.SetDnsPolicy(policy)
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.google.com.", dns.TypeA)
+	payload, _ := query.Pack()
+	// the server only listens on tcp, a direct udp query gets no answer
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: ln.Addr().(*net.TCPAddr).Port}
+	raw, ip, udp := clientUDP(t, dst, payload)
+	t2s.dnsServer.handleUdp(raw, ip, udp)
+
+	select {
+	case name := <-seen:
+		if name != SAFESEARCH_GOOGLE+"." {
+			t.Errorf("proxied query for %s", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SafeSearch target never resolved through the proxy")
+	}
+	pkt, ok := nextWrite(t2s, 5*time.Second).(*udpPacket)
+	if !ok {
+		t.Fatal("no answer written to the tun")
+	}
+	resp := new(dns.Msg)
+	if e := resp.Unpack(pkt.udp.Payload); e != nil {
+		t.Fatal(e)
+	}
+	if len(resp.Answer) != 2 {
+		t.Errorf("answer %v", resp)
+	}
+}
@@ -1,6 +1,7 @@
 package tun2socks
 
 import (
+	"encoding/binary"
 	"fmt"
 	"log"
 	"net"
@@ -35,8 +36,18 @@ const (
 	LAST_ACK    tcpState = 0x6
 	TIME_WAIT   tcpState = 0x7
 
-	MAX_RECV_WINDOW int = 65535
-	MAX_SEND_WINDOW int = 65535
+	// default buffer sizes, see SetTcpBuffers
+	DEFAULT_RECV_BUFFER int = 256 * 1024
+	DEFAULT_SEND_BUFFER int = 256 * 1024
+	// windows beyond 64k need the window scale option, RFC 7323
+	MAX_UNSCALED_WINDOW int   = 65535
+	MAX_WINDOW_SCALE    uint8 = 14
+	// ip and tcp headers without options, the mss is the mtu less these
+	IPV4_TCP_HEADERS = 40
+	IPV6_TCP_HEADERS = 60
+	// mss assumed when a SYN carries none, RFC 9293
+	DEFAULT_MSS_IPV4 = 536
+	DEFAULT_MSS_IPV6 = 1220
 
 	CONNECT_NOT_SENT    = -1
 	CONNECT_SENT        = 0
@@ -44,6 +55,9 @@ const (
 
 	TIMEOUT    = 120 * time.Second
 	ACTTIMEOUT = 1000 * time.Millisecond
+
+	MAX_SNIFF_BYTES = 4096
+	SNIFF_TIMEOUT   = 300 * time.Millisecond
 )
 
 type tcpConnTrack struct {
@@ -74,9 +88,23 @@ type tcpConnTrack struct {
 	// what I have acked
 	lastAck uint32
 
-	// flow control
+	// sent segments waiting for an ack
+	unacked tcpSendQueue
+	// received segments waiting for the gap before them
+	outOfOrder      []*tcpPacket
+	outOfOrderBytes int
+	lastOutOfOrder  uint32
+	sackPermitted   bool
+	// largest payload of a segment sent to the tun
+	mss int
+
+	// flow control, windows are in bytes and scaled on the wire
 	recvWindow  int32
 	sendWindow  int32
+	recvBuffer  int32
+	sendBuffer  int32
+	rcvScale    uint8
+	sndScale    uint8
 	sendWndCond *sync.Cond
 	recvWndCond *sync.Cond
 	destroyed   bool
@@ -87,6 +115,12 @@ type tcpConnTrack struct {
 	uid         int
 
 	proxyServer *ProxyServer
+
+	// deferred dial context
+	hostname   string
+	sniffBuf   []byte
+	sniffStart time.Time
+	sniChecked bool
 }
 
 var (
@@ -254,7 +288,7 @@ func rst(srcIP net.IP, dstIP net.IP, srcPort uint16, dstPort uint16, seq uint32,
 
 	tcphdr.DstPort = srcPort
 	tcphdr.SrcPort = dstPort
-	tcphdr.Window = uint16(MAX_RECV_WINDOW)
+	tcphdr.Window = uint16(MAX_UNSCALED_WINDOW)
 	tcphdr.RST = true
 	tcphdr.ACK = true
 	tcphdr.Seq = 0
@@ -339,13 +373,53 @@ func (tt *tcpConnTrack) synAck(syn *tcpPacket) {
 
 	tcphdr.SrcPort = tt.remotePort
 	tcphdr.DstPort = tt.localPort
-	tcphdr.Window = uint16(atomic.LoadInt32(&tt.recvWindow))
 	tcphdr.SYN = true
 	tcphdr.ACK = true
 	tcphdr.Seq = tt.nxtSeq
 	tcphdr.Ack = tt.rcvNxtSeq
 
-	tcphdr.Options = []packet.TCPOption{{2, 4, []byte{0x5, 0xb4}}}
+	mss, defaultMss := tt.t2s.mtu-IPV4_TCP_HEADERS, DEFAULT_MSS_IPV4
+	if tt.remoteIP.To4() == nil {
+		mss, defaultMss = tt.t2s.mtu-IPV6_TCP_HEADERS, DEFAULT_MSS_IPV6
+	}
+	// segments follow the smaller of our mss and the client's
+	tt.mss = defaultMss
+	if opt, ok := syn.tcp.FindOption(packet.TCPOptionKindMSS); ok && len(opt.OptionData) == 2 {
+		if clientMss := int(binary.BigEndian.Uint16(opt.OptionData)); clientMss > 0 {
+			tt.mss = clientMss
+		}
+	}
+	if tt.mss > mss {
+		tt.mss = mss
+	}
+	tcphdr.Options = []packet.TCPOption{{
+		OptionType: packet.TCPOptionKindMSS,
+		OptionData: []byte{byte(mss >> 8), byte(mss)},
+	}}
+	if _, ok := syn.tcp.FindOption(packet.TCPOptionKindSACKPermitted); ok {
+		tt.sackPermitted = true
+		tcphdr.Options = append(tcphdr.Options, packet.TCPOption{OptionType: packet.TCPOptionKindSACKPermitted})
+	}
+	if opt, ok := syn.tcp.FindOption(packet.TCPOptionKindWindowScale); ok && len(opt.OptionData) == 1 {
+		tt.sndScale = opt.OptionData[0]
+		if tt.sndScale > MAX_WINDOW_SCALE {
+			tt.sndScale = MAX_WINDOW_SCALE
+		}
+		tt.rcvScale = windowScale(int(tt.recvBuffer))
+		tcphdr.Options = append(tcphdr.Options,
+			packet.TCPOption{OptionType: packet.TCPOptionKindNop},
+			packet.TCPOption{OptionType: packet.TCPOptionKindWindowScale, OptionData: []byte{tt.rcvScale}})
+	} else if tt.recvBuffer > int32(MAX_UNSCALED_WINDOW) {
+		// the client can't scale, the window stops at 64k
+		tt.recvBuffer = int32(MAX_UNSCALED_WINDOW)
+		atomic.StoreInt32(&tt.recvWindow, tt.recvBuffer)
+	}
+	// the window of a SYN is never scaled
+	wnd := atomic.LoadInt32(&tt.recvWindow)
+	if wnd > int32(MAX_UNSCALED_WINDOW) {
+		wnd = int32(MAX_UNSCALED_WINDOW)
+	}
+	tcphdr.Window = uint16(wnd)
 
 	synAck := packTCP(iphdr, tcphdr)
 	tt.send(synAck)
@@ -354,32 +428,8 @@ func (tt *tcpConnTrack) synAck(syn *tcpPacket) {
 }
 
 func (tt *tcpConnTrack) finAck() {
-	tcphdr := packet.NewTCP()
-
-	var iphdr *packet.Ip
-	if tt.remoteIP.To4() != nil {
-		iphdr = packet.NewIP4()
-		iphdr.V4.Id = packet.IPID()
-	} else {
-		iphdr = packet.NewIP6()
-	}
-
-	iphdr.Src = tt.remoteIP
-	iphdr.Dst = tt.localIP
-
-	iphdr.SetHopLimit(64)
-	iphdr.SetNextProto(packet.IPProtocolTCP)
-
-	tcphdr.SrcPort = tt.remotePort
-	tcphdr.DstPort = tt.localPort
-	tcphdr.Window = uint16(atomic.LoadInt32(&tt.recvWindow))
-	tcphdr.FIN = true
-	tcphdr.ACK = true
-	tcphdr.Seq = tt.nxtSeq
-	tcphdr.Ack = tt.rcvNxtSeq
-
-	finAck := packTCP(iphdr, tcphdr)
-	tt.send(finAck)
+	tt.unacked.push(&tcpSegment{seq: tt.nxtSeq, fin: true, sent: time.Now()})
+	tt.send(tt.segment(tt.nxtSeq, nil, true))
 	// FIN counts 1 seq
 	tt.nxtSeq += 1
 }
@@ -403,16 +453,43 @@ func (tt *tcpConnTrack) ack() {
 
 	tcphdr.SrcPort = tt.remotePort
 	tcphdr.DstPort = tt.localPort
-	tcphdr.Window = uint16(atomic.LoadInt32(&tt.recvWindow))
+	tcphdr.Window = tt.advertisedWindow()
 	tcphdr.ACK = true
 	tcphdr.Seq = tt.nxtSeq
 	tcphdr.Ack = tt.rcvNxtSeq
+	tcphdr.Options = tt.sackOptions()
 
 	ack := packTCP(iphdr, tcphdr)
 	tt.send(ack)
 }
 
 func (tt *tcpConnTrack) payload(data []byte) {
+	for len(data) > 0 {
+		n := tt.segmentSize()
+		if n > len(data) {
+			n = len(data)
+		}
+		// kept until acked for retransmission
+		tt.unacked.push(&tcpSegment{seq: tt.nxtSeq, data: data[:n], sent: time.Now()})
+		tt.send(tt.segment(tt.nxtSeq, data[:n], false))
+		// adjust seq
+		tt.nxtSeq = tt.nxtSeq + uint32(n)
+		data = data[n:]
+	}
+}
+
+// segmentSize is the payload that fits a segment along with the SACK
+// blocks it will carry, RFC 6691
+func (tt *tcpConnTrack) segmentSize() int {
+	size := tt.mss
+	if tt.sackPermitted && len(tt.outOfOrder) > 0 {
+		size -= 4 + 8*len(tt.sackBlocks())
+	}
+	return size
+}
+
+// segment builds the packet carrying data and/or a FIN from seq
+func (tt *tcpConnTrack) segment(seq uint32, data []byte, fin bool) *tcpPacket {
 	tcphdr := packet.NewTCP()
 
 	var iphdr *packet.Ip
@@ -431,65 +508,114 @@ func (tt *tcpConnTrack) payload(data []byte) {
 
 	tcphdr.SrcPort = tt.remotePort
 	tcphdr.DstPort = tt.localPort
-	tcphdr.Window = uint16(atomic.LoadInt32(&tt.recvWindow))
+	tcphdr.Window = tt.advertisedWindow()
 	tcphdr.ACK = true
-	tcphdr.PSH = true
-	tcphdr.Seq = tt.nxtSeq
+	tcphdr.PSH = len(data) > 0
+	tcphdr.FIN = fin
+	tcphdr.Seq = seq
 	tcphdr.Ack = tt.rcvNxtSeq
+	tcphdr.Options = tt.sackOptions()
 	tcphdr.Payload = data
 
-	pkt := packTCP(iphdr, tcphdr)
-	tt.send(pkt)
-	// adjust seq
-	tt.nxtSeq = tt.nxtSeq + uint32(len(data))
+	return packTCP(iphdr, tcphdr)
 }
 
-// stateClosed receives a SYN packet, tries to connect the socks proxy, gives a
-// SYN/ACK if success, otherwise RST
-func (tt *tcpConnTrack) stateClosed(syn *tcpPacket) (continu bool, release bool) {
+// dialUpstream connects the socks proxy, the http proxy or the destination
+// itself, depending on the proxy configured for the app owning the flow
+func (tt *tcpConnTrack) dialUpstream() error {
 	var e error
 
+	if tt.connectState != CONNECT_NOT_SENT {
+		return fmt.Errorf("connect already sent")
+	}
+
 	var remoteIpPort string
 	if tt.remoteIP.To4() != nil {
 		remoteIpPort = fmt.Sprintf("%s:%d", tt.remoteIP.String(), tt.remotePort)
 	} else {
 		remoteIpPort = fmt.Sprintf("[%s]:%d", tt.remoteIP.String(), tt.remotePort)
 	}
-	if !isPrivate(tt.remoteIP) && (tt.remotePort == 80 || tt.remotePort == 443) {
-		if tt.uid == -1 {
-			uid := tt.t2s.FindAppUid(tt.localIP.String(), tt.localPort, tt.remoteIP.String(), tt.remotePort)
-			tt.uid = uid
-			tt.loadProxyConfig()
-		}
+	if tt.uid == -1 {
+		tt.uid = tt.t2s.FindAppUid(tt.localIP.String(), tt.localPort, tt.remoteIP.String(), tt.remotePort)
+	}
+	if tt.remotePort == 53 && tt.t2s.dnsEnabled {
+		// answered by the engine's resolver like udp queries
+		tt.proxyServer = directProxyServer
+		tt.socksConn, e = tt.t2s.dnsServer.serveTcp(tt)
+		return e
+	}
+	if len(tt.hostname) == 0 {
+		tt.hostname, _ = tt.t2s.fakeIpHostname(tt.remoteIP)
+	}
+	// a name learned from dns is good enough for routing, the CONNECT request
+	// still waits for the SNI when there is one
+	hostname := tt.hostname
+	if len(hostname) == 0 {
+		hostname = tt.t2s.hostMap.lookup(tt.remoteIP)
+	}
+
+	if tt.t2s.dnsBypass(tt.remoteIP, tt.remotePort, hostname) {
+		return fmt.Errorf("%s (%s) is an encrypted dns resolver", remoteIpPort, hostname)
+	}
 
-		if tt.proxyServer.ProxyType == PROXY_TYPE_SOCKS {
-			tt.socksConn, e = dialLocalSocks(tt.proxyServer) //only 80 and 443 goes to proxy
-		} else if tt.proxyServer.ProxyType == PROXY_TYPE_HTTP || tt.proxyServer.ProxyType == PROXY_TYPE_TRANSPARENT {
-			tt.socksConn, e = dialTlsTunneling(tt.proxyServer.IpAddress)
-			if len(syn.tcp.Hostname) > 0 && tt.proxyServer.ProxyType == PROXY_TYPE_HTTP && tt.remotePort == 443 {
-				tt.callHttpProxyConnect(tt.socksConn, tt.remoteIP, syn.tcp)
+	action, proxyServer := tt.t2s.route(&RouteRequest{
+		Uid:      tt.uid,
+		Hostname: hostname,
+		DstIP:    tt.remoteIP,
+		DstPort:  tt.remotePort,
+		Protocol: packet.IPProtocolTCP,
+	})
+	if action == ROUTE_REJECT {
+		return fmt.Errorf("%s (%s) rejected by routing rules", remoteIpPort, hostname)
+	}
+	tt.proxyServer = proxyServer
+	log.Printf("Proxy selected for %s (%s): address %s, type: %d", remoteIpPort, hostname, tt.proxyServer.IpAddress, tt.proxyServer.ProxyType)
+
+	if tt.proxyServer.ProxyType == PROXY_TYPE_SOCKS {
+		tt.socksConn, e = dialLocalSocks(tt.proxyServer)
+	} else if tt.proxyServer.ProxyType == PROXY_TYPE_HTTP || tt.proxyServer.ProxyType == PROXY_TYPE_TRANSPARENT {
+		tt.socksConn, e = dialTlsTunneling(tt.proxyServer.IpAddress)
+		if e == nil && len(tt.hostname) > 0 && tt.proxyServer.ProxyType == PROXY_TYPE_HTTP && tt.remotePort != 80 {
+			e = tt.callHttpProxyConnect(tt.socksConn, tt.remoteIP)
+			if e != nil {
+				tt.socksConn.Close()
+			} else {
+				tt.connectState = CONNECT_SENT
 			}
-		} else {
-			tt.socksConn, e = dialTransaprent(remoteIpPort)
 		}
 	} else {
-		tt.socksConn, e = dialTransaprent(remoteIpPort)
+		var dialIp net.IP
+		dialIp, e = tt.t2s.realIp(tt.remoteIP)
+		if e == nil {
+			tt.socksConn, e = dialTransaprent(joinHostPort(dialIp, tt.remotePort))
+		}
 	}
 
 	if e != nil {
-		log.Printf("fail to connect proxy: %s", e)
-		resp := rstByPacket(syn)
-		tt.toTunCh <- resp.wire
-		return false, true
-	} else {
-		// no timeout
-		tt.socksConn.SetDeadline(time.Time{})
+		tt.socksConn = nil
+		return e
+	}
+	if tt.socksConn == nil {
+		return fmt.Errorf("no connection to %s", remoteIpPort)
 	}
+	// no timeout
+	tt.socksConn.SetDeadline(time.Time{})
+	return nil
+}
 
-	if tt.socksConn == nil || tt.connectState != CONNECT_NOT_SENT {
-		resp := rstByPacket(syn)
-		tt.toTunCh <- resp.wire
-		return false, true
+// stateClosed receives a SYN packet, tries to connect the socks proxy, gives a
+// SYN/ACK if success, otherwise RST. In deferred dial mode the handshake is
+// completed locally and the upstream is dialed once the first client payload
+// has been sniffed.
+func (tt *tcpConnTrack) stateClosed(syn *tcpPacket) (continu bool, release bool) {
+	if !tt.t2s.deferredDial {
+		tt.hostname = syn.tcp.Hostname
+		e := tt.dialUpstream()
+		if e != nil {
+			log.Printf("fail to connect proxy: %s", e)
+			tt.refuse(syn)
+			return false, true
+		}
 	}
 
 	// context variables
@@ -501,11 +627,52 @@ func (tt *tcpConnTrack) stateClosed(syn *tcpPacket) (continu bool, release bool)
 	return true, true
 }
 
+// refuse answers a SYN that won't be connected with a RST or ICMP
+// unreachable, as set with SetRejectAction
+func (tt *tcpConnTrack) refuse(syn *tcpPacket) {
+	if action := tt.t2s.rejectAction; action != REJECT_RESET {
+		tt.toTunCh <- unreachable(syn.ip, syn.wire, action)
+		return
+	}
+	tt.toTunCh <- rstByPacket(syn)
+}
+
+// sniff buffers payload the client sent before the upstream was dialed and
+// reports whether it's enough to know the hostname
+func (tt *tcpConnTrack) sniff(data []byte) bool {
+	tt.sniffBuf = append(tt.sniffBuf, data...)
+	hostname, complete := packet.SniffHostname(tt.sniffBuf)
+	if len(hostname) > 0 {
+		tt.hostname = hostname
+	}
+	return complete || len(tt.sniffBuf) >= MAX_SNIFF_BYTES
+}
+
+// connectDeferred dials the upstream for a connection whose handshake was
+// completed locally and starts relaying, or resets the client on failure
+func (tt *tcpConnTrack) connectDeferred() bool {
+	tt.sniffBuf = nil
+	e := tt.dialUpstream()
+	if e != nil {
+		log.Printf("fail to connect proxy: %s", e)
+		resp := rst(tt.localIP, tt.remoteIP, tt.localPort, tt.remotePort, tt.rcvNxtSeq, tt.nxtSeq, 0)
+		tt.toTunCh <- resp
+		tt.destroyed = true
+		return false
+	}
+
+	tcpReadWriteTaskPool.SubmitAsyncTask(func() {
+		tt.tcpSocks2Tun(tt.remoteIP, uint16(tt.remotePort), tt.socksConn, tt.fromSocksCh, tt.toSocksCh, tt.socksCloseCh)
+	})
+	return true
+}
+
 func (tt *tcpConnTrack) callSocks(dstIP net.IP, dstPort uint16, conn net.Conn, closeCh chan bool) error {
+	hostType, dstHost := socksHost(dstIP, tt.hostname)
 	_, e := gosocks.WriteSocksRequest(conn, &gosocks.SocksRequest{
 		Cmd:      gosocks.SocksCmdConnect,
-		HostType: gosocks.SocksIPv4Host,
-		DstHost:  dstIP.String(),
+		HostType: hostType,
+		DstHost:  dstHost,
 		DstPort:  dstPort,
 	})
 	if e != nil {
@@ -531,12 +698,16 @@ func (tt *tcpConnTrack) callSocks(dstIP net.IP, dstPort uint16, conn net.Conn, c
 	return nil
 }
 
-func (tt *tcpConnTrack) callHttpProxyConnect(conn net.Conn, dstIp net.IP, tcp *packet.TCP) error {
+func (tt *tcpConnTrack) callHttpProxyConnect(conn net.Conn, dstIp net.IP) error {
 	//"CONNECT %s:443 HTTP/1.1\r\nProxy-Authorization: Basic %s\r\nConnection: close\r\n\r\n",
-	if len(tcp.Hostname) == 0 {
-		tcp.Hostname = dstIp.String()
+	hostname := tt.hostname
+	if len(hostname) == 0 {
+		hostname = tt.t2s.hostMap.lookup(dstIp)
+	}
+	if len(hostname) == 0 {
+		hostname = dstIp.String()
 	}
-	connectString := fmt.Sprintf("CONNECT %s:443 HTTP/1.1\r\nProxy-Authorization: Basic %s\r\nConnection: close\r\n\r\n", tcp.Hostname, tt.proxyServer.AuthHeader)
+	connectString := fmt.Sprintf("CONNECT %s:%d HTTP/1.1\r\nProxy-Authorization: Basic %s\r\nConnection: close\r\n\r\n", hostname, tt.remotePort, tt.proxyServer.AuthHeader)
 	_, err := conn.Write([]byte(connectString))
 	if err != nil {
 		log.Println(err)
@@ -547,33 +718,19 @@ func (tt *tcpConnTrack) callHttpProxyConnect(conn net.Conn, dstIp net.IP, tcp *p
 }
 
 func (tt *tcpConnTrack) loadProxyConfig() {
-	proxyServer, ok := tt.t2s.proxyServerMap[tt.uid]
-	if !ok {
-		tt.proxyServer = tt.t2s.defaultProxyServer
-	} else {
-		tt.proxyServer = proxyServer
-	}
-	log.Printf("Proxy selected: address %s, type: %d", tt.proxyServer.IpAddress, tt.proxyServer.ProxyType)
+	tt.proxyServer = tt.t2s.uidProxy(tt.uid)
 }
 
 func (tt *tcpConnTrack) tcpSocks2Tun(dstIP net.IP, dstPort uint16, conn net.Conn, readCh chan<- []byte, writeCh <-chan *tcpPacket, closeCh chan bool) {
-	if tt.uid == -1 {
-		uid := tt.t2s.FindAppUid(tt.localIP.String(), tt.localPort, dstIP.String(), dstPort)
-		tt.uid = uid
-		tt.loadProxyConfig()
-	}
-
-	if !isPrivate(dstIP) && (dstPort == 443 || dstPort == 80) {
-		if tt.proxyServer.ProxyType == PROXY_TYPE_SOCKS {
-			e := tt.callSocks(dstIP, dstPort, conn, closeCh)
-			if e != nil {
-				tt.destroyed = true
-				return
-			}
+	if tt.proxyServer.ProxyType == PROXY_TYPE_SOCKS {
+		e := tt.callSocks(dstIP, dstPort, conn, closeCh)
+		if e != nil {
+			tt.destroyed = true
+			return
 		}
 	}
 
-	if tt.proxyServer.ProxyType != PROXY_TYPE_HTTP || dstPort != 443 || isPrivate(dstIP) {
+	if tt.proxyServer.ProxyType != PROXY_TYPE_HTTP || dstPort == 80 {
 		tt.connectState = CONNECT_ESTABLISHED
 	}
 
@@ -591,7 +748,10 @@ func (tt *tcpConnTrack) tcpSocks2Tun(dstIP net.IP, dstPort uint16, conn net.Conn
 			return
 		case pkt := <-writeCh:
 			if tt.connectState == CONNECT_NOT_SENT {
-				err := tt.callHttpProxyConnect(conn, dstIP, pkt.tcp)
+				if len(tt.hostname) == 0 {
+					tt.hostname = pkt.tcp.Hostname
+				}
+				err := tt.callHttpProxyConnect(conn, dstIP)
 				if err != nil {
 					log.Printf("Can't send connect request")
 				}
@@ -606,7 +766,7 @@ func (tt *tcpConnTrack) tcpSocks2Tun(dstIP net.IP, dstPort uint16, conn net.Conn
 					tt.recvWndCond.L.Unlock()
 				}
 
-				if pkt.tcp.DstPort == 443 {
+				if pkt.tcp.DstPort != 80 {
 					conn.Write(pkt.tcp.Payload)
 				} else {
 					conn.Write(pkt.tcp.PatchHostForPlainHttp(tt.proxyServer.AuthHeader))
@@ -619,8 +779,8 @@ func (tt *tcpConnTrack) tcpSocks2Tun(dstIP net.IP, dstPort uint16, conn net.Conn
 			// increase window when processed
 			wnd := atomic.LoadInt32(&tt.recvWindow)
 			wnd += int32(len(pkt.tcp.Payload))
-			if wnd > int32(MAX_RECV_WINDOW) {
-				wnd = int32(MAX_RECV_WINDOW)
+			if wnd > tt.recvBuffer {
+				wnd = tt.recvBuffer
 			}
 			atomic.StoreInt32(&tt.recvWindow, wnd)
 
@@ -660,8 +820,8 @@ func (tt *tcpConnTrack) tcpSocks2Tun(dstIP net.IP, dstPort uint16, conn net.Conn
 			}
 
 			cur = wnd
-			if cur > MTU-40 {
-				cur = MTU - 40
+			if cur > int32(tt.mss) {
+				cur = int32(tt.mss)
 			}
 			// tt.sendWndCond.L.Unlock()
 			if tt.connectState == CONNECT_SENT {
@@ -734,25 +894,57 @@ func (tt *tcpConnTrack) stateSynRcvd(pkt *tcpPacket) (continu bool, release bool
 	continu = true
 	release = true
 	tt.changeState(ESTABLISHED)
-	tcpReadWriteTaskPool.SubmitAsyncTask(func() {
-		tt.tcpSocks2Tun(tt.remoteIP, uint16(tt.remotePort), tt.socksConn, tt.fromSocksCh, tt.toSocksCh, tt.socksCloseCh)
-	})
+	if tt.socksConn != nil {
+		tcpReadWriteTaskPool.SubmitAsyncTask(func() {
+			tt.tcpSocks2Tun(tt.remoteIP, uint16(tt.remotePort), tt.socksConn, tt.fromSocksCh, tt.toSocksCh, tt.socksCloseCh)
+		})
+	} else {
+		tt.sniffStart = time.Now()
+	}
+
+	return tt.relayEstablished(pkt)
+}
 
+// relayEstablished hands the payload to the socks writer, sniffing it first if
+// the upstream hasn't been dialed yet
+func (tt *tcpConnTrack) relayEstablished(pkt *tcpPacket) (continu bool, release bool) {
+	continu = true
+	release = true
+	sniffed := false
 	if len(pkt.tcp.Payload) != 0 {
+		if tt.socksConn == nil {
+			sniffed = tt.sniff(pkt.tcp.Payload)
+		} else if !tt.sniChecked && tt.t2s.dnsBypassPort(tt.remotePort) && tt.sniff(pkt.tcp.Payload) {
+			// a ClientHello can span several segments, its SNI is checked
+			// once it's complete
+			tt.sniChecked = true
+			tt.sniffBuf = nil
+			if tt.t2s.dnsBypass(tt.remoteIP, tt.remotePort, tt.hostname) {
+				resp := rst(tt.localIP, tt.remoteIP, tt.localPort, tt.remotePort, tt.rcvNxtSeq, tt.nxtSeq, 0)
+				tt.toTunCh <- resp
+				return false, true
+			}
+		}
 		if tt.relayPayload(pkt) {
 			// pkt hands to socks writer
 			release = false
 		}
 	}
+	if tt.socksConn == nil && (sniffed || pkt.tcp.FIN) {
+		// the sniffed hostname is checked when dialing
+		tt.sniChecked = true
+		continu = tt.connectDeferred()
+	}
 	return
 }
 
 func (tt *tcpConnTrack) stateEstablished(pkt *tcpPacket) (continu bool, release bool) {
-	// ack if sequence is not expected
+	// ack if sequence is not expected, segments ahead are held for later
 	if !tt.validSeq(pkt) {
+		held := tt.holdOutOfOrder(pkt)
 		tt.ack()
 
-		return true, true
+		return true, !held
 	}
 	// connection ends by valid RST
 	if pkt.tcp.RST {
@@ -763,15 +955,21 @@ func (tt *tcpConnTrack) stateEstablished(pkt *tcpPacket) (continu bool, release
 		return true, true
 	}
 
-	continu = true
-	release = true
-	if len(pkt.tcp.Payload) != 0 {
-		if tt.relayPayload(pkt) {
-			// pkt hands to socks writer
-			release = false
+	fin := pkt.tcp.FIN
+	continu, release = tt.relayEstablished(pkt)
+	if !continu {
+		return
+	}
+	if fin {
+		tt.dropOutOfOrder()
+	} else if len(tt.outOfOrder) > 0 {
+		if !tt.deliverOutOfOrder() {
+			return false, release
 		}
+		// a filled gap is acked right away
+		tt.ack()
 	}
-	if pkt.tcp.FIN {
+	if fin {
 		tt.rcvNxtSeq += 1
 		tt.finAck()
 		tt.changeState(LAST_ACK)
@@ -804,6 +1002,9 @@ func (tt *tcpConnTrack) stateFinWait1(pkt *tcpPacket) (continu bool, release boo
 			tt.changeState(CLOSING)
 			return false, true
 		}
+	} else if len(tt.unacked.segments) > 0 {
+		// data or FIN still in flight, keep retransmitting
+		return true, true
 	} else {
 		tt.changeState(FIN_WAIT_2)
 		return false, true
@@ -868,9 +1069,45 @@ func (tt *tcpConnTrack) newPacket(pkt *tcpPacket) {
 	}
 }
 
+// windowScale is the smallest shift that fits buffer in the 16 bit window
+func windowScale(buffer int) uint8 {
+	var scale uint8
+	for buffer>>scale > MAX_UNSCALED_WINDOW && scale < MAX_WINDOW_SCALE {
+		scale++
+	}
+	return scale
+}
+
+// advertisedWindow is recvWindow as it goes in the header
+func (tt *tcpConnTrack) advertisedWindow() uint16 {
+	wnd := int(atomic.LoadInt32(&tt.recvWindow) >> tt.rcvScale)
+	if wnd > MAX_UNSCALED_WINDOW {
+		wnd = MAX_UNSCALED_WINDOW
+	}
+	return uint16(wnd)
+}
+
 func (tt *tcpConnTrack) updateSendWindow(pkt *tcpPacket) {
+	wnd := int32(pkt.tcp.Window)
+	if !pkt.tcp.SYN {
+		wnd <<= tt.sndScale
+	}
+	// data in flight is bounded by the send buffer
+	if wnd > tt.sendBuffer {
+		wnd = tt.sendBuffer
+	}
+	// the window starts at the segment's ack, what's sent past it is in
+	// flight, usable is SND.UNA + SND.WND - SND.NXT
+	una := tt.nxtSeq
+	if pkt.tcp.ACK && !seqAfter(pkt.tcp.Ack, tt.nxtSeq) {
+		una = pkt.tcp.Ack
+	}
+	wnd -= int32(tt.nxtSeq - una)
+	if wnd < 0 {
+		wnd = 0
+	}
 	// tt.sendWndCond.L.Lock()
-	atomic.StoreInt32(&tt.sendWindow, int32(pkt.tcp.Window))
+	atomic.StoreInt32(&tt.sendWindow, wnd)
 	tt.sendWndCond.Signal()
 	// tt.sendWndCond.L.Unlock()
 }
@@ -905,18 +1142,22 @@ func (tt *tcpConnTrack) run() {
 			if tt.socksConn != nil {
 				tt.socksConn.Close()
 			}
+			tt.unacked.clear()
+			tt.dropOutOfOrder()
 			close(tt.quitBySelf)
 			tt.t2s.clearTCPConnTrack(tt.id)
 			log.Print("Runner exit")
 			return
 		}
 
+		rtoTimeout := tt.unacked.timeout()
 		select {
 		case pkt := <-tt.input:
 			var continu, release bool
 
 			tt.lastPacketTime = time.Now()
 
+			tt.onAck(pkt)
 			tt.updateSendWindow(pkt)
 			switch tt.state {
 			case CLOSED:
@@ -944,6 +1185,8 @@ func (tt *tcpConnTrack) run() {
 				if tt.socksConn != nil {
 					tt.socksConn.Close()
 				}
+				tt.unacked.clear()
+				tt.dropOutOfOrder()
 				close(tt.quitBySelf)
 				tt.t2s.clearTCPConnTrack(tt.id)
 
@@ -955,6 +1198,13 @@ func (tt *tcpConnTrack) run() {
 				// have something to ack
 				tt.ack()
 			}
+			if tt.socksConn == nil && time.Now().Sub(tt.sniffStart) > SNIFF_TIMEOUT {
+				// client waits for the server to speak first
+				tt.connectDeferred()
+			}
+
+		case <-rtoTimeout:
+			tt.onRetransmitTimeout()
 
 		case data := <-fromSocksCh:
 			tt.lastPacketTime = time.Now()
@@ -967,6 +1217,8 @@ func (tt *tcpConnTrack) run() {
 			if tt.socksConn != nil {
 				tt.socksConn.Close()
 			}
+			tt.unacked.clear()
+			tt.dropOutOfOrder()
 			return
 		}
 
@@ -998,8 +1250,10 @@ func (t2s *Tun2Socks) createTCPConnTrack(id string, ip *packet.Ip, tcp *packet.T
 
 		lastPacketTime: time.Now(),
 
-		sendWindow:  int32(MAX_SEND_WINDOW),
-		recvWindow:  int32(MAX_RECV_WINDOW),
+		sendWindow:  int32(t2s.tcpSendBuffer),
+		recvWindow:  int32(t2s.tcpRecvBuffer),
+		sendBuffer:  int32(t2s.tcpSendBuffer),
+		recvBuffer:  int32(t2s.tcpRecvBuffer),
 		sendWndCond: &sync.Cond{L: &sync.Mutex{}},
 		recvWndCond: &sync.Cond{L: &sync.Mutex{}},
 
@@ -1071,6 +1325,11 @@ func (t2s *Tun2Socks) tcp(raw []byte, ip *packet.Ip, tcp *packet.TCP) {
 			return
 		}
 
+		if t2s.dnsBypass(ip.Dst, tcp.DstPort, "") {
+			t2s.writeCh <- rst(ip.Src, ip.Dst, tcp.SrcPort, tcp.DstPort, tcp.Seq, tcp.Ack, 0)
+			return
+		}
+
 		pkt := copyTCPPacket(raw, ip, tcp)
 		track := t2s.createTCPConnTrack(connID, ip, tcp)
 		track.newPacket(pkt)
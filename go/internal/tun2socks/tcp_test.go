@@ -0,0 +1,544 @@
+package tun2socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+// acceptSocks answers socks CONNECTs without dialing the target and hands
+// the connections over, so tests play the upstream
+func acceptSocks(ln net.Listener, conns chan<- net.Conn) {
+	for {
+		c, e := ln.Accept()
+		if e != nil {
+			return
+		}
+		conn := &gosocks.SocksConn{Conn: c, Timeout: 5 * time.Second}
+		if _, e := gosocks.ReadSocksRequest(conn); e != nil {
+			c.Close()
+			continue
+		}
+		gosocks.WriteSocksReply(conn, &gosocks.SocksReply{Rep: gosocks.SocksSucceeded, HostType: gosocks.SocksIPv4Host, BndHost: "0.0.0.0"})
+		conns <- c
+	}
+}
+
+// tcpTestUpstream points the engine's default proxy at a socks server whose
+// connections come out of the returned channel
+func tcpTestUpstream(t *testing.T, t2s *Tun2Socks) chan net.Conn {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { ln.Close() })
+	conns := make(chan net.Conn, 1)
+	go acceptSocks(ln, conns)
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: ln.Addr().String()})
+	return conns
+}
+
+// tcpClient plays the app's side of a connection from 10.0.0.4:40000
+type tcpClient struct {
+	t    *testing.T
+	t2s  *Tun2Socks
+	dst  net.IP
+	port uint16
+	// next sequence number to send and the engine's one to ack
+	seq uint32
+	ack uint32
+	// sequence number of the next data the engine relays
+	dataSeq uint32
+	// offer SACK in the SYN
+	sack bool
+}
+
+func newTcpClient(t *testing.T, t2s *Tun2Socks, dst net.IP, port uint16) *tcpClient {
+	return &tcpClient{t: t, t2s: t2s, dst: dst.To4(), port: port, seq: 1000}
+}
+
+func (c *tcpClient) send(tcp *packet.TCP) {
+	ip := packet.NewIP4()
+	ip.SetHopLimit(64)
+	ip.SetNextProto(packet.IPProtocolTCP)
+	ip.Src = net.IPv4(10, 0, 0, 4).To4()
+	ip.Dst = c.dst
+	tcp.SrcPort = 40000
+	tcp.DstPort = c.port
+	if tcp.Window == 0 {
+		tcp.Window = 0xffff
+	}
+
+	buf := make([]byte, MTU)
+	start := packTCP(ip, tcp).packTcpIntoBuff(buf)
+	raw := buf[start:]
+	parsed := parseWire(c.t, raw)
+	seg := &packet.TCP{}
+	if e := packet.ParseTCP(parsed.Payload, seg); e != nil {
+		c.t.Fatalf("parse tcp: %s", e)
+	}
+	c.t2s.tcp(raw, parsed, seg)
+}
+
+// connect runs the handshake and returns the engine's SYN/ACK
+func (c *tcpClient) connect() *packet.TCP {
+	options := []packet.TCPOption{{
+		OptionType: packet.TCPOptionKindMSS,
+		OptionData: []byte{0x05, 0xb4},
+	}}
+	if c.sack {
+		options = append(options, packet.TCPOption{OptionType: packet.TCPOptionKindSACKPermitted})
+	}
+	c.send(&packet.TCP{SYN: true, Seq: c.seq, Options: options})
+	c.seq++
+	synAck := c.next(5 * time.Second)
+	if synAck == nil || !synAck.SYN || !synAck.ACK {
+		c.t.Fatalf("no SYN/ACK, got %+v", synAck)
+	}
+	c.ack = synAck.Seq + 1
+	c.dataSeq = c.ack
+	c.acknowledge(c.ack)
+	return synAck
+}
+
+func (c *tcpClient) acknowledge(ack uint32) {
+	c.send(&packet.TCP{ACK: true, Seq: c.seq, Ack: ack})
+}
+
+func (c *tcpClient) write(data []byte) {
+	c.send(&packet.TCP{ACK: true, PSH: true, Seq: c.seq, Ack: c.ack, Payload: data})
+	c.seq += uint32(len(data))
+}
+
+// next returns the next tcp segment the engine writes to the tun, nil after
+// wait
+func (c *tcpClient) next(wait time.Duration) *packet.TCP {
+	deadline := time.Now().Add(wait)
+	for {
+		pkt := nextWrite(c.t2s, time.Until(deadline))
+		if pkt == nil {
+			return nil
+		}
+		if seg, ok := pkt.(*tcpPacket); ok {
+			tcp := *seg.tcp
+			tcp.Payload = append([]byte(nil), seg.tcp.Payload...)
+			return &tcp
+		}
+	}
+}
+
+// nextData skips pure ACKs and window updates
+func (c *tcpClient) nextData(wait time.Duration) *packet.TCP {
+	deadline := time.Now().Add(wait)
+	for {
+		seg := c.next(time.Until(deadline))
+		if seg == nil || len(seg.Payload) > 0 || seg.FIN || seg.RST {
+			return seg
+		}
+	}
+}
+
+// waitSegment returns the first segment the engine writes that match
+// accepts, others are skipped, nil after wait
+func (c *tcpClient) waitSegment(wait time.Duration, match func(seg *packet.TCP) bool) *packet.TCP {
+	deadline := time.Now().Add(wait)
+	for {
+		seg := c.next(time.Until(deadline))
+		if seg == nil || match(seg) {
+			return seg
+		}
+	}
+}
+
+// waitData waits for a segment carrying data from seq
+func (c *tcpClient) waitData(wait time.Duration, seq uint32) *packet.TCP {
+	return c.waitSegment(wait, func(seg *packet.TCP) bool {
+		return seg.Seq == seq && len(seg.Payload) > 0
+	})
+}
+
+// clientHello returns the first record a TLS client sends for serverName
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	defer client.Close()
+
+	hello := make([]byte, 5)
+	if _, e := io.ReadFull(server, hello); e != nil {
+		t.Fatal(e)
+	}
+	hello = append(hello, make([]byte, int(hello[3])<<8|int(hello[4]))...)
+	if _, e := io.ReadFull(server, hello[5:]); e != nil {
+		t.Fatal(e)
+	}
+	return hello
+}
+
+func TestTcpSniCheckedAcrossSegments(t *testing.T) {
+	for _, c := range []struct {
+		host   string
+		bypass bool
+	}{
+		{"dns.google", true},
+		{"example.com", false},
+	} {
+		t2s := newTestEngine()
+		conns := tcpTestUpstream(t, t2s)
+		list := NewDnsBypassList()
+		list.AddHost("dns.google")
+		policy := NewDnsPolicy()
+		policy.SetBypassList(list)
+		t2s.SetDnsPolicy(policy)
+
+		client := newTcpClient(t, t2s, net.IPv4(192, 0, 2, 1), 443)
+		client.connect()
+		var upstream net.Conn
+		select {
+		case upstream = <-conns:
+			t.Cleanup(func() { upstream.Close() })
+		case <-time.After(5 * time.Second):
+			t.Fatal("upstream never dialed")
+		}
+
+		// the SNI only arrives with the second segment
+		hello := clientHello(t, c.host)
+		client.write(hello[:20])
+		client.write(hello[20:])
+
+		rst := false
+		for seg := client.next(time.Second); seg != nil; seg = client.next(time.Second) {
+			rst = rst || seg.RST
+		}
+		if rst != c.bypass {
+			t.Errorf("%s: reset %v", c.host, rst)
+		}
+		if !c.bypass {
+			relayed := make([]byte, len(hello))
+			upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, e := io.ReadFull(upstream, relayed); e != nil || !bytes.Equal(relayed, hello) {
+				t.Errorf("%s: ClientHello not relayed: %v", c.host, e)
+			}
+		}
+	}
+}
+
+// connectUpstream connects a client to 192.0.2.1:443 through a test socks
+// server and returns the server side of the upstream
+func connectUpstream(t *testing.T) (*Tun2Socks, *tcpClient, net.Conn) {
+	t2s := newTestEngine()
+	conns := tcpTestUpstream(t, t2s)
+	client := newTcpClient(t, t2s, net.IPv4(192, 0, 2, 1), 443)
+	client.connect()
+	select {
+	case upstream := <-conns:
+		// referenced until the test ends, a collected conn would close and
+		// the relay would send a FIN
+		t.Cleanup(func() { upstream.Close() })
+		// relayed once the socks reply is read, the upstream can speak then
+		client.write([]byte("hi"))
+		upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, e := io.ReadFull(upstream, make([]byte, 2)); e != nil {
+			t.Fatal(e)
+		}
+		return t2s, client, upstream
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream never dialed")
+	}
+	return nil, nil, nil
+}
+
+// upstreamSegment has the upstream send data and returns the segment the
+// engine carries it in
+func upstreamSegment(t *testing.T, client *tcpClient, upstream net.Conn, data []byte) *packet.TCP {
+	upstream.Write(data)
+	seg := client.waitData(5*time.Second, client.dataSeq)
+	client.dataSeq += uint32(len(data))
+	if seg == nil || !bytes.Equal(seg.Payload, data) {
+		t.Fatalf("segment %+v", seg)
+	}
+	return seg
+}
+
+func TestTcpRetransmitsAfterRto(t *testing.T) {
+	_, client, upstream := connectUpstream(t)
+	sent := time.Now()
+	seg := upstreamSegment(t, client, upstream, []byte("hello"))
+
+	// the segment is lost, nothing acks it
+	again := client.waitData(3*RTO_INITIAL, seg.Seq)
+	if again == nil || !bytes.Equal(again.Payload, seg.Payload) {
+		t.Fatalf("retransmission %+v", again)
+	}
+	if elapsed := time.Since(sent); elapsed < RTO_INITIAL-100*time.Millisecond {
+		t.Errorf("retransmitted after %s", elapsed)
+	}
+}
+
+func TestTcpFastRetransmit(t *testing.T) {
+	_, client, upstream := connectUpstream(t)
+	sent := time.Now()
+	first := upstreamSegment(t, client, upstream, bytes.Repeat([]byte("a"), 100))
+	upstreamSegment(t, client, upstream, bytes.Repeat([]byte("b"), 100))
+
+	// the first segment is lost, the second one draws duplicate ACKs
+	for i := 1; i < DUP_ACK_THRESHOLD; i++ {
+		client.acknowledge(first.Seq)
+	}
+	if seg := client.nextData(100 * time.Millisecond); seg != nil {
+		t.Fatalf("retransmitted before the third duplicate ACK: %+v", seg)
+	}
+	client.acknowledge(first.Seq)
+	seg := client.waitData(RTO_INITIAL/2, first.Seq)
+	if seg == nil || !bytes.Equal(seg.Payload, first.Payload) {
+		t.Fatalf("fast retransmission %+v", seg)
+	}
+	if elapsed := time.Since(sent); elapsed >= RTO_INITIAL {
+		t.Errorf("retransmitted after %s, not before the RTO", elapsed)
+	}
+}
+
+func TestTcpRetransmitsAfterPartialAck(t *testing.T) {
+	_, client, upstream := connectUpstream(t)
+	data := testDatagram(100)
+	seg := upstreamSegment(t, client, upstream, data)
+
+	// the client only got the first 40 bytes
+	client.acknowledge(seg.Seq + 40)
+	again := client.waitData(3*RTO_INITIAL, seg.Seq+40)
+	if again == nil || !bytes.Equal(again.Payload, data[40:]) {
+		t.Fatalf("retransmission %+v", again)
+	}
+}
+
+// idleTrack is an established track that isn't running, tests call its
+// handlers directly
+func idleTrack(t2s *Tun2Socks) *tcpConnTrack {
+	return &tcpConnTrack{
+		t2s:        t2s,
+		id:         "test",
+		toTunCh:    t2s.writeCh,
+		localIP:    net.IPv4(10, 0, 0, 4).To4(),
+		remoteIP:   net.IPv4(192, 0, 2, 1).To4(),
+		localPort:  40000,
+		remotePort: 443,
+		mss:        1000,
+		nxtSeq:     5000,
+		rcvNxtSeq:  1000,
+	}
+}
+
+func ackPacket(ack uint32) *tcpPacket {
+	return packTCP(packet.NewIP4(), &packet.TCP{ACK: true, Ack: ack, Window: 0xffff})
+}
+
+func TestTcpRttSampling(t *testing.T) {
+	t2s := newTestEngine()
+	for _, retransmitted := range []bool{false, true} {
+		tt := idleTrack(t2s)
+		tt.payload([]byte("hello"))
+		tt.unacked.segments[0].sent = time.Now().Add(-50 * time.Millisecond)
+		if retransmitted {
+			tt.unacked.deadline = time.Now()
+			tt.onRetransmitTimeout()
+		}
+		tt.onAck(ackPacket(tt.nxtSeq))
+
+		// Karn's rule, an ACK for a retransmitted segment isn't a sample
+		if retransmitted && (tt.unacked.srtt != 0 || tt.unacked.rto != 2*RTO_INITIAL) {
+			t.Errorf("sampled a retransmitted segment: srtt %s rto %s", tt.unacked.srtt, tt.unacked.rto)
+		}
+		if !retransmitted && tt.unacked.srtt < 50*time.Millisecond {
+			t.Errorf("srtt %s", tt.unacked.srtt)
+		}
+		if len(tt.unacked.segments) != 0 {
+			t.Errorf("%d segments left", len(tt.unacked.segments))
+		}
+		for nextWrite(t2s, 10*time.Millisecond) != nil {
+		}
+	}
+}
+
+func TestTcpDroppedAfterMaxRetransmits(t *testing.T) {
+	t2s := newTestEngine()
+	tt := idleTrack(t2s)
+	tt.payload([]byte("hello"))
+	if nextWrite(t2s, time.Second) == nil {
+		t.Fatal("segment not sent")
+	}
+
+	retransmits := 0
+	for !tt.destroyed {
+		tt.unacked.deadline = time.Now()
+		tt.onRetransmitTimeout()
+		pkt, ok := nextWrite(t2s, time.Second).(*tcpPacket)
+		if !ok {
+			t.Fatal("nothing written on timeout")
+		}
+		if !pkt.tcp.RST {
+			retransmits++
+			continue
+		}
+		// SND.UNA and RCV.NXT exactly
+		if !tt.destroyed || pkt.tcp.Seq != 5000 || pkt.tcp.Ack != tt.rcvNxtSeq || !pkt.tcp.ACK || pkt.tcp.DstPort != tt.localPort {
+			t.Errorf("reset seq %d ack %d to port %d, destroyed %v", pkt.tcp.Seq, pkt.tcp.Ack, pkt.tcp.DstPort, tt.destroyed)
+		}
+	}
+	if retransmits != MAX_RETRANSMITS {
+		t.Errorf("%d retransmissions", retransmits)
+	}
+}
+
+// dataPacket is a segment from the client carrying data from seq
+func dataPacket(seq uint32, data []byte) *tcpPacket {
+	return packTCP(packet.NewIP4(), &packet.TCP{ACK: true, Seq: seq, Payload: data, Window: 0xffff})
+}
+
+func TestTcpOutOfOrderBoundedByRecvBuffer(t *testing.T) {
+	tt := idleTrack(newTestEngine())
+	tt.recvBuffer = 300
+
+	if !tt.holdOutOfOrder(dataPacket(1100, make([]byte, 100))) {
+		t.Fatal("segment within the buffer not held")
+	}
+	// ends 350 bytes past RCV.NXT
+	if tt.holdOutOfOrder(dataPacket(1250, make([]byte, 100))) {
+		t.Error("held a segment past the receive buffer")
+	}
+	// already covered by the held one
+	if tt.holdOutOfOrder(dataPacket(1120, make([]byte, 50))) {
+		t.Error("held a duplicate segment")
+	}
+	if tt.holdOutOfOrder(dataPacket(1000, make([]byte, 50))) {
+		t.Error("held an in-order segment")
+	}
+	if len(tt.outOfOrder) != 1 || tt.outOfOrderBytes != 100 {
+		t.Errorf("%d segments, %d bytes held", len(tt.outOfOrder), tt.outOfOrderBytes)
+	}
+}
+
+func TestTcpSackBlocks(t *testing.T) {
+	tt := idleTrack(newTestEngine())
+	tt.recvBuffer = int32(DEFAULT_RECV_BUFFER)
+	hold := func(seq uint32, n int) {
+		if !tt.holdOutOfOrder(dataPacket(seq, make([]byte, n))) {
+			t.Fatalf("segment at %d not held", seq)
+		}
+	}
+	check := func(want ...sackBlock) {
+		t.Helper()
+		blocks := tt.sackBlocks()
+		if len(blocks) != len(want) {
+			t.Fatalf("blocks %v, want %v", blocks, want)
+		}
+		for i := range want {
+			if blocks[i] != want[i] {
+				t.Fatalf("blocks %v, want %v", blocks, want)
+			}
+		}
+	}
+
+	hold(1100, 100)
+	hold(1500, 100)
+	hold(1300, 100)
+	// the most recent block first, the others in sequence order
+	check(sackBlock{1300, 1400}, sackBlock{1100, 1200}, sackBlock{1500, 1600})
+
+	// a segment next to a held one extends its block
+	hold(1200, 50)
+	check(sackBlock{1100, 1250}, sackBlock{1300, 1400}, sackBlock{1500, 1600})
+
+	hold(1700, 100)
+	hold(1900, 100)
+	hold(2100, 100)
+	check(sackBlock{2100, 2200}, sackBlock{1100, 1250}, sackBlock{1300, 1400}, sackBlock{1500, 1600})
+	if len(tt.sackBlocks()) != MAX_SACK_BLOCKS {
+		t.Errorf("%d blocks", len(tt.sackBlocks()))
+	}
+}
+
+func TestTcpOutOfOrderDelivered(t *testing.T) {
+	t2s := newTestEngine()
+	conns := tcpTestUpstream(t, t2s)
+	client := newTcpClient(t, t2s, net.IPv4(192, 0, 2, 1), 443)
+	client.sack = true
+	client.connect()
+	var upstream net.Conn
+	select {
+	case upstream = <-conns:
+		t.Cleanup(func() { upstream.Close() })
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream never dialed")
+	}
+
+	// "world" arrives ahead of "hello"
+	gap := client.seq
+	client.send(&packet.TCP{ACK: true, PSH: true, Seq: gap + 5, Ack: client.ack, Payload: []byte("world")})
+	dupAck := client.waitSegment(5*time.Second, func(seg *packet.TCP) bool {
+		return seg.ACK && len(seg.Payload) == 0
+	})
+	if dupAck == nil || dupAck.Ack != gap {
+		t.Fatalf("duplicate ACK %+v", dupAck)
+	}
+	sack, ok := dupAck.FindOption(packet.TCPOptionKindSACK)
+	if !ok || len(sack.OptionData) != 8 ||
+		binary.BigEndian.Uint32(sack.OptionData) != gap+5 || binary.BigEndian.Uint32(sack.OptionData[4:]) != gap+10 {
+		t.Fatalf("SACK option %+v", sack)
+	}
+
+	client.write([]byte("hello"))
+	client.seq += 5
+	filled := client.waitSegment(5*time.Second, func(seg *packet.TCP) bool {
+		return seg.ACK && len(seg.Payload) == 0 && seg.Ack == gap+10
+	})
+	if filled == nil {
+		t.Fatal("filled gap not acked")
+	}
+	if _, ok := filled.FindOption(packet.TCPOptionKindSACK); ok {
+		t.Error("SACK option with nothing held")
+	}
+	upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, 10)
+	if _, e := io.ReadFull(upstream, got); e != nil || string(got) != "helloworld" {
+		t.Fatalf("upstream read %q, %v", got, e)
+	}
+}
+
+func TestTcpSendWindowExcludesInFlight(t *testing.T) {
+	t2s := newTestEngine()
+	tt := idleTrack(t2s)
+	tt.sendBuffer = int32(DEFAULT_SEND_BUFFER)
+	tt.sendWndCond = sync.NewCond(&sync.Mutex{})
+	tt.payload(make([]byte, 600))
+
+	// 600 bytes in flight, 200 of them acked, the client has room for 1000
+	pkt := ackPacket(5200)
+	pkt.tcp.Window = 1000
+	tt.updateSendWindow(pkt)
+	if wnd := atomic.LoadInt32(&tt.sendWindow); wnd != 600 {
+		t.Errorf("send window %d, want 600", wnd)
+	}
+
+	// a window smaller than what's in flight leaves nothing usable
+	pkt.tcp.Window = 300
+	tt.updateSendWindow(pkt)
+	if wnd := atomic.LoadInt32(&tt.sendWindow); wnd != 0 {
+		t.Errorf("send window %d, want 0", wnd)
+	}
+
+	pkt = ackPacket(tt.nxtSeq)
+	pkt.tcp.Window = 300
+	tt.updateSendWindow(pkt)
+	if wnd := atomic.LoadInt32(&tt.sendWindow); wnd != 300 {
+		t.Errorf("send window %d, want 300", wnd)
+	}
+}
@@ -0,0 +1,162 @@
+package tun2socks
+
+import (
+	"encoding/binary"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+const (
+	// without timestamps four blocks fit in the option space
+	MAX_SACK_BLOCKS = 4
+)
+
+type sackBlock struct {
+	left  uint32
+	right uint32
+}
+
+// compact copies the payload out of the mtu buffer, so a packet held for
+// long costs only its data
+func (pkt *tcpPacket) compact() {
+	if pkt.mtuBuf == nil {
+		return
+	}
+	data := make([]byte, len(pkt.tcp.Payload))
+	copy(data, pkt.tcp.Payload)
+	pkt.tcp.Payload = data
+	pkt.tcp.Options = nil
+	pkt.tcp.Padding = nil
+	pkt.ip.Src = nil
+	pkt.ip.Dst = nil
+	pkt.ip.Payload = nil
+	releaseBuffer(pkt.mtuBuf)
+	pkt.mtuBuf = nil
+	pkt.wire = nil
+}
+
+// holdOutOfOrder keeps a segment that arrived ahead of rcvNxtSeq until the
+// gap before it fills, returns false if the segment was not kept
+func (tt *tcpConnTrack) holdOutOfOrder(pkt *tcpPacket) bool {
+	tcp := pkt.tcp
+	payloadLen := len(tcp.Payload)
+	if payloadLen == 0 || tcp.SYN || tcp.FIN || tcp.RST || !tcp.ACK {
+		return false
+	}
+	end := tcp.Seq + uint32(payloadLen)
+	// held data is bounded by the receive buffer
+	if !seqAfter(tcp.Seq, tt.rcvNxtSeq) || int(end-tt.rcvNxtSeq) > int(tt.recvBuffer) {
+		return false
+	}
+	if tt.outOfOrderBytes+payloadLen > int(tt.recvBuffer) {
+		return false
+	}
+
+	// sorted by sequence, segments already covered are dropped
+	pos := len(tt.outOfOrder)
+	for i, held := range tt.outOfOrder {
+		heldEnd := held.tcp.Seq + uint32(len(held.tcp.Payload))
+		if !seqAfter(held.tcp.Seq, tcp.Seq) && !seqAfter(end, heldEnd) {
+			return false
+		}
+		if seqAfter(held.tcp.Seq, tcp.Seq) {
+			pos = i
+			break
+		}
+	}
+	pkt.compact()
+	tt.outOfOrder = append(tt.outOfOrder, nil)
+	copy(tt.outOfOrder[pos+1:], tt.outOfOrder[pos:])
+	tt.outOfOrder[pos] = pkt
+	tt.outOfOrderBytes += payloadLen
+	tt.lastOutOfOrder = tcp.Seq
+	return true
+}
+
+// deliverOutOfOrder relays the held segments that became contiguous with
+// rcvNxtSeq, trimming what was already received
+func (tt *tcpConnTrack) deliverOutOfOrder() (continu bool) {
+	for len(tt.outOfOrder) > 0 {
+		pkt := tt.outOfOrder[0]
+		if seqAfter(pkt.tcp.Seq, tt.rcvNxtSeq) {
+			return true
+		}
+		tt.outOfOrder[0] = nil
+		tt.outOfOrder = tt.outOfOrder[1:]
+		tt.outOfOrderBytes -= len(pkt.tcp.Payload)
+
+		end := pkt.tcp.Seq + uint32(len(pkt.tcp.Payload))
+		if !seqAfter(end, tt.rcvNxtSeq) {
+			releaseTCPPacket(pkt)
+			continue
+		}
+		pkt.tcp.Payload = pkt.tcp.Payload[tt.rcvNxtSeq-pkt.tcp.Seq:]
+		pkt.tcp.Seq = tt.rcvNxtSeq
+
+		continu, release := tt.relayEstablished(pkt)
+		if release {
+			releaseTCPPacket(pkt)
+		}
+		if !continu {
+			return false
+		}
+	}
+	return true
+}
+
+func (tt *tcpConnTrack) dropOutOfOrder() {
+	for _, pkt := range tt.outOfOrder {
+		releaseTCPPacket(pkt)
+	}
+	tt.outOfOrder = nil
+	tt.outOfOrderBytes = 0
+}
+
+// sackBlocks merges the held segments into blocks, the one holding the most
+// recent segment first as RFC 2018 asks
+func (tt *tcpConnTrack) sackBlocks() []sackBlock {
+	var blocks []sackBlock
+	recent := -1
+	for _, pkt := range tt.outOfOrder {
+		left := pkt.tcp.Seq
+		right := left + uint32(len(pkt.tcp.Payload))
+		if n := len(blocks); n > 0 && !seqAfter(left, blocks[n-1].right) {
+			if seqAfter(right, blocks[n-1].right) {
+				blocks[n-1].right = right
+			}
+		} else {
+			blocks = append(blocks, sackBlock{left: left, right: right})
+		}
+		if pkt.tcp.Seq == tt.lastOutOfOrder {
+			recent = len(blocks) - 1
+		}
+	}
+	if recent > 0 {
+		first := blocks[recent]
+		copy(blocks[1:recent+1], blocks[:recent])
+		blocks[0] = first
+	}
+	if len(blocks) > MAX_SACK_BLOCKS {
+		blocks = blocks[:MAX_SACK_BLOCKS]
+	}
+	return blocks
+}
+
+// sackOptions returns the SACK option for an outgoing ACK, nil if the client
+// didn't negotiate SACK or nothing is held
+func (tt *tcpConnTrack) sackOptions() []packet.TCPOption {
+	if !tt.sackPermitted || len(tt.outOfOrder) == 0 {
+		return nil
+	}
+	blocks := tt.sackBlocks()
+	data := make([]byte, 8*len(blocks))
+	for i, block := range blocks {
+		binary.BigEndian.PutUint32(data[8*i:], block.left)
+		binary.BigEndian.PutUint32(data[8*i+4:], block.right)
+	}
+	return []packet.TCPOption{
+		{OptionType: packet.TCPOptionKindNop},
+		{OptionType: packet.TCPOptionKindNop},
+		{OptionType: packet.TCPOptionKindSACK, OptionData: data},
+	}
+}
@@ -0,0 +1,210 @@
+package tun2socks
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// RFC 6298 timer, the 200ms floor follows Linux rather than the RFC's
+	// 1s since the peer sits behind a local tun
+	RTO_INITIAL     = 1 * time.Second
+	RTO_MIN         = 200 * time.Millisecond
+	RTO_MAX         = 60 * time.Second
+	RTO_GRANULARITY = 10 * time.Millisecond
+
+	DUP_ACK_THRESHOLD = 3
+	// retransmissions of one segment before the connection is dropped
+	MAX_RETRANSMITS = 8
+)
+
+// seqAfter compares sequence numbers modulo 2^32
+func seqAfter(a uint32, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// tcpSegment is data sent to the tun and not acked yet, a FIN takes one
+// sequence number after the data
+type tcpSegment struct {
+	seq           uint32
+	data          []byte
+	fin           bool
+	sent          time.Time
+	retransmitted bool
+}
+
+func (s *tcpSegment) end() uint32 {
+	end := s.seq + uint32(len(s.data))
+	if s.fin {
+		end++
+	}
+	return end
+}
+
+// tcpSendQueue keeps the segments the tun side hasn't acked and times their
+// retransmission
+type tcpSendQueue struct {
+	segments []*tcpSegment
+
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	deadline time.Time
+	timer    *time.Timer
+	retries  int
+
+	dupAcks    int
+	lastWindow uint16
+}
+
+func (q *tcpSendQueue) push(seg *tcpSegment) {
+	if q.rto == 0 {
+		q.rto = RTO_INITIAL
+	}
+	if len(q.segments) == 0 {
+		q.deadline = seg.sent.Add(q.rto)
+	}
+	q.segments = append(q.segments, seg)
+}
+
+// sample updates the RTO from a round trip measured on a segment sent once
+func (q *tcpSendQueue) sample(rtt time.Duration) {
+	if q.srtt == 0 {
+		q.srtt = rtt
+		q.rttvar = rtt / 2
+	} else {
+		delta := q.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		q.rttvar = (3*q.rttvar + delta) / 4
+		q.srtt = (7*q.srtt + rtt) / 8
+	}
+	variance := 4 * q.rttvar
+	if variance < RTO_GRANULARITY {
+		variance = RTO_GRANULARITY
+	}
+	q.rto = q.srtt + variance
+	if q.rto < RTO_MIN {
+		q.rto = RTO_MIN
+	} else if q.rto > RTO_MAX {
+		q.rto = RTO_MAX
+	}
+}
+
+// ack drops what an ACK covers and reports whether it was the third
+// duplicate, the signal for a fast retransmit
+func (q *tcpSendQueue) ack(ack uint32, window uint16, pure bool) bool {
+	windowChanged := window != q.lastWindow
+	q.lastWindow = window
+	if len(q.segments) == 0 {
+		return false
+	}
+
+	una := q.segments[0].seq
+	if !seqAfter(ack, una) {
+		if ack == una && pure && !windowChanged {
+			q.dupAcks++
+			return q.dupAcks == DUP_ACK_THRESHOLD
+		}
+		return false
+	}
+
+	now := time.Now()
+	var rtt time.Duration
+	for len(q.segments) > 0 {
+		seg := q.segments[0]
+		if seqAfter(seg.end(), ack) {
+			if seqAfter(ack, seg.seq) {
+				// partially acked
+				seg.data = seg.data[ack-seg.seq:]
+				seg.seq = ack
+			}
+			break
+		}
+		// Karn's algorithm, retransmitted segments give ambiguous samples
+		if !seg.retransmitted {
+			rtt = now.Sub(seg.sent)
+		}
+		q.segments[0] = nil
+		q.segments = q.segments[1:]
+	}
+	if rtt > 0 {
+		q.sample(rtt)
+	}
+	q.dupAcks = 0
+	q.retries = 0
+	q.deadline = now.Add(q.rto)
+	return false
+}
+
+// timeout returns a channel firing at the retransmission deadline, nil with
+// nothing in flight
+func (q *tcpSendQueue) timeout() <-chan time.Time {
+	if len(q.segments) == 0 {
+		return nil
+	}
+	wait := time.Until(q.deadline)
+	if q.timer == nil {
+		q.timer = time.NewTimer(wait)
+	} else {
+		q.timer.Stop()
+		q.timer.Reset(wait)
+	}
+	return q.timer.C
+}
+
+func (q *tcpSendQueue) clear() {
+	q.segments = nil
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+}
+
+// onAck feeds an ACK from the tun to the send queue
+func (tt *tcpConnTrack) onAck(pkt *tcpPacket) {
+	if !pkt.tcp.ACK || pkt.tcp.RST || seqAfter(pkt.tcp.Ack, tt.nxtSeq) {
+		return
+	}
+	pure := len(pkt.tcp.Payload) == 0 && !pkt.tcp.SYN && !pkt.tcp.FIN
+	if tt.unacked.ack(pkt.tcp.Ack, pkt.tcp.Window, pure) {
+		tt.retransmit()
+	}
+}
+
+// onRetransmitTimeout resends the oldest segment and backs the timer off,
+// the connection is dropped after MAX_RETRANSMITS
+func (tt *tcpConnTrack) onRetransmitTimeout() {
+	q := &tt.unacked
+	if len(q.segments) == 0 || time.Now().Before(q.deadline) {
+		return
+	}
+	if q.retries >= MAX_RETRANSMITS {
+		log.Printf("[TCP][%s] no ack after %d retransmissions", tt.id, q.retries)
+		// from SND.UNA with RCV.NXT, the only RST RFC 5961 accepts outright
+		resp := tt.segment(q.segments[0].seq, nil, false)
+		resp.tcp.RST = true
+		resp.tcp.Options = nil
+		tt.toTunCh <- resp
+		tt.destroyed = true
+		return
+	}
+	q.retries++
+	q.rto *= 2
+	if q.rto > RTO_MAX {
+		q.rto = RTO_MAX
+	}
+	q.deadline = time.Now().Add(q.rto)
+	tt.retransmit()
+}
+
+func (tt *tcpConnTrack) retransmit() {
+	seg := tt.unacked.segments[0]
+	seg.retransmitted = true
+	// SACK blocks may have grown since, the rest goes after the partial ack
+	if n := tt.segmentSize(); len(seg.data) > n {
+		tt.send(tt.segment(seg.seq, seg.data[:n], false))
+		return
+	}
+	tt.send(tt.segment(seg.seq, seg.data, seg.fin))
+}
@@ -0,0 +1,79 @@
+package tun2socks
+
+import (
+	"strings"
+)
+
+// domainTrie stores domains by reversed labels, a domain matches if it or
+// one of its parents was added
+type domainTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	terminal bool
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{}
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+func (t *domainTrie) add(domain string) {
+	domain = normalizeDomain(domain)
+	if len(domain) == 0 {
+		return
+	}
+
+	node := &t.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.terminal {
+			// parent already blocks the whole subtree
+			return
+		}
+		if node.children == nil {
+			node.children = make(map[string]*trieNode)
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &trieNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	if !node.terminal {
+		node.terminal = true
+		// children are covered by this node now
+		node.children = nil
+	}
+}
+
+func (t *domainTrie) match(domain string) bool {
+	domain = normalizeDomain(domain)
+	node := &t.root
+	for len(domain) > 0 {
+		label := domain
+		dot := strings.LastIndexByte(domain, '.')
+		if dot >= 0 {
+			label = domain[dot+1:]
+			domain = domain[:dot]
+		} else {
+			domain = ""
+		}
+
+		child, ok := node.children[label]
+		if !ok {
+			return false
+		}
+		if child.terminal {
+			return true
+		}
+		node = child
+	}
+	return false
+}
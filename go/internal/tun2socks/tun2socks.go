@@ -1,12 +1,16 @@
 package tun2socks
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"sync"
 	"time"
 
@@ -17,6 +21,10 @@ import (
 
 const (
 	MTU = 10240
+	// smallest mtu every IPv4 host must accept
+	MIN_MTU = 576
+	// ethernet mtu, what a tun gets when the app sets none
+	DEFAULT_MTU = 1500
 
 	PROXY_TYPE_NONE        = 0
 	PROXY_TYPE_SOCKS       = 1
@@ -79,6 +87,9 @@ type UidCallback interface {
 
 type Tun2Socks struct {
 	dev io.ReadWriteCloser
+	// mtu of the tun, packets written to it are fragmented to fit and tcp
+	// segments sized from it
+	mtu int
 
 	writeCh chan interface{}
 
@@ -86,19 +97,42 @@ type Tun2Socks struct {
 	proxyServerMap     map[int]*ProxyServer
 	defaultProxyServer *ProxyServer
 	uidCallback        UidCallback
+	router             *Router
 
 	tcpConnTrackLock      sync.Mutex
 	ipDirectConnTrackLock sync.Mutex
 
 	udpConnTrackLock sync.Mutex
 	udpConnTrackMap  map[string]*udpConnTrack
-	stopped          bool
+
+	icmpEchoTrackLock sync.Mutex
+	icmpEchoTrackMap  map[string]*icmpEchoTrack
+
+	stopped bool
 
 	wg sync.WaitGroup
 
-	customDnsHost4 net.IP
-	customDnsHost6 net.IP
-	customDnsPort  uint16
+	customDnsHost4        net.IP
+	customDnsHost6        net.IP
+	customDnsPort         uint16
+	customDnsUpstreamLock sync.Mutex
+	customDnsUpstream     dnsUpstream
+
+	deferredDial bool
+	rejectAction int
+
+	tcpRecvBuffer int
+	tcpSendBuffer int
+
+	dnsServer  *dnsServer
+	dnsEnabled bool
+	fakeIp     bool
+	fakeIpPool *fakeIpPool
+	dnsPolicy  *DnsPolicy
+	dnsLog     *DnsLog
+	hostMap    *hostMap
+
+	reassembler *reassembler
 }
 
 func (t2s *Tun2Socks) Stopped() bool {
@@ -137,12 +171,98 @@ func dialTransaprent(localAddr string) (*gosocks.SocksConn, error) {
 	return directDialer.Dial(localAddr)
 }
 
-func New(dev io.ReadWriteCloser, dnsServerIp4, dnsServerIp6 net.IP, dnsServerPort uint16) *Tun2Socks {
+// dialThroughProxy opens a tcp connection for the engine's own traffic,
+// tunneled through the proxy the same way app flows are
+func dialThroughProxy(ctx context.Context, proxy *ProxyServer, address string) (net.Conn, error) {
+	if proxy == nil || proxy.ProxyType == PROXY_TYPE_NONE {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	if proxy.ProxyType == PROXY_TYPE_TRANSPARENT {
+		return dialTlsTunneling(proxy.IpAddress)
+	}
+
+	host, portString, e := net.SplitHostPort(address)
+	if e != nil {
+		return nil, e
+	}
+	port, e := strconv.ParseUint(portString, 10, 16)
+	if e != nil {
+		return nil, e
+	}
+
+	if proxy.ProxyType == PROXY_TYPE_SOCKS {
+		conn, e := dialLocalSocks(proxy)
+		if e != nil {
+			return nil, e
+		}
+		hostType, dstHost := gosocks.ParseHost(host)
+		reply, e := gosocks.ClientRequest(conn, &gosocks.SocksRequest{
+			Cmd:      gosocks.SocksCmdConnect,
+			HostType: hostType,
+			DstHost:  dstHost,
+			DstPort:  uint16(port),
+		})
+		if e == nil && reply.Rep != gosocks.SocksSucceeded {
+			e = fmt.Errorf("socks connect request fail, retcode: %d", reply.Rep)
+		}
+		if e != nil {
+			conn.Close()
+			return nil, e
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+
+	conn, e := dialTlsTunneling(proxy.IpAddress)
+	if e != nil {
+		return nil, e
+	}
+	conn.SetDeadline(time.Now().Add(conn.Timeout))
+	connectString := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n", address, address, proxy.AuthHeader)
+	_, e = conn.Write([]byte(connectString))
+	if e == nil {
+		var resp *http.Response
+		resp, e = http.ReadResponse(bufio.NewReader(conn), nil)
+		if e == nil && resp.StatusCode != http.StatusOK {
+			e = fmt.Errorf("http proxy replied %s", resp.Status)
+		}
+	}
+	if e != nil {
+		conn.Close()
+		return nil, e
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socksHost picks the socks address for a destination, a known hostname is
+// preferred so the proxy can resolve and filter by name itself
+func socksHost(ip net.IP, hostname string) (byte, string) {
+	if len(hostname) > 0 && len(hostname) <= 255 && net.ParseIP(hostname) == nil {
+		return gosocks.SocksDomainHost, hostname
+	}
+	if ip.To4() != nil {
+		return gosocks.SocksIPv4Host, ip.String()
+	}
+	return gosocks.SocksIPv6Host, ip.String()
+}
+
+// New creates the engine for a tun configured with mtu, clamped to
+// MIN_MTU..MTU
+func New(dev io.ReadWriteCloser, mtu int, dnsServerIp4, dnsServerIp6 net.IP, dnsServerPort uint16) *Tun2Socks {
+	if mtu < MIN_MTU {
+		mtu = MIN_MTU
+	} else if mtu > MTU {
+		mtu = MTU
+	}
 	t2s := &Tun2Socks{
 		dev:                dev,
+		mtu:                mtu,
 		writeCh:            make(chan interface{}, 10000),
 		tcpConnTrackMap:    make(map[string]*tcpConnTrack),
 		udpConnTrackMap:    make(map[string]*udpConnTrack),
+		icmpEchoTrackMap:   make(map[string]*icmpEchoTrack),
 		proxyServerMap:     make(map[int]*ProxyServer),
 		uidCallback:        nil,
 		defaultProxyServer: nil,
@@ -150,7 +270,14 @@ func New(dev io.ReadWriteCloser, dnsServerIp4, dnsServerIp6 net.IP, dnsServerPor
 		customDnsHost4:     dnsServerIp4,
 		customDnsHost6:     dnsServerIp6,
 		customDnsPort:      dnsServerPort,
+		dnsEnabled:         true,
+		tcpRecvBuffer:      DEFAULT_RECV_BUFFER,
+		tcpSendBuffer:      DEFAULT_SEND_BUFFER,
 	}
+	t2s.dnsServer = newDnsServer(t2s)
+	t2s.fakeIpPool = newFakeIpPool()
+	t2s.hostMap = newHostMap()
+	t2s.reassembler = newReassembler()
 	return t2s
 }
 
@@ -162,6 +289,113 @@ func (t2s *Tun2Socks) SetDefaultProxy(proxy *ProxyServer) {
 	t2s.defaultProxyServer = proxy
 }
 
+// SetDeferredDial makes tcp tracks finish the handshake locally and dial the
+// upstream only after the hostname is sniffed from the first client payload
+func (t2s *Tun2Socks) SetDeferredDial(enabled bool) {
+	t2s.deferredDial = enabled
+}
+
+// SetTcpBuffers sets the receive window offered to apps and the data sent
+// to them unacked per connection, for connections opened afterwards. Zero
+// keeps the default, windows over 64k need the client to support scaling.
+func (t2s *Tun2Socks) SetTcpBuffers(recv int, send int) {
+	limit := MAX_UNSCALED_WINDOW << MAX_WINDOW_SCALE
+	if recv > 0 {
+		if recv > limit {
+			recv = limit
+		}
+		t2s.tcpRecvBuffer = recv
+	}
+	if send > 0 {
+		if send > limit {
+			send = limit
+		}
+		t2s.tcpSendBuffer = send
+	}
+}
+
+// SetRejectAction sets how rejected flows and failed dials are refused, one
+// of REJECT_RESET, REJECT_ICMP_PORT or REJECT_ICMP_ADMIN. Connections whose
+// handshake was completed locally are always reset.
+func (t2s *Tun2Socks) SetRejectAction(action int) {
+	t2s.rejectAction = action
+}
+
+// SetDnsUrl makes the dns forwarder send queries to an encrypted upstream,
+// https://dns.example/dns-query or tls://dns.example[:853], through proxy if
+// not nil. An empty url goes back to the plain udp servers.
+func (t2s *Tun2Socks) SetDnsUrl(url string, proxy *ProxyServer) error {
+	var upstream dnsUpstream
+	if len(url) > 0 {
+		var e error
+		upstream, e = newDnsUpstream(url, proxy)
+		if e != nil {
+			return e
+		}
+	}
+	t2s.setDnsUpstream(upstream)
+	return nil
+}
+
+// SetDnsUpstreams makes the forwarder use a list of servers with the given
+// DNS_STRATEGY_*, an empty list goes back to the original destination
+func (t2s *Tun2Socks) SetDnsUpstreams(servers []DnsUpstreamConfig, strategy int, proxy *ProxyServer) error {
+	if len(servers) == 0 {
+		t2s.setDnsUpstream(nil)
+		return nil
+	}
+	group, e := newDnsUpstreamGroup(servers, strategy, proxy)
+	if e != nil {
+		return e
+	}
+	t2s.setDnsUpstream(group)
+	return nil
+}
+
+func (t2s *Tun2Socks) setDnsUpstream(upstream dnsUpstream) {
+	t2s.customDnsUpstreamLock.Lock()
+	old := t2s.customDnsUpstream
+	t2s.customDnsUpstream = upstream
+	t2s.customDnsUpstreamLock.Unlock()
+	if closer, ok := old.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// dnsUpstream returns the upstream set with SetDnsUrl or SetDnsUpstreams, nil
+// if none is
+func (t2s *Tun2Socks) dnsUpstream() dnsUpstream {
+	t2s.customDnsUpstreamLock.Lock()
+	defer t2s.customDnsUpstreamLock.Unlock()
+	return t2s.customDnsUpstream
+}
+
+// SetDnsForwarder switches between answering port 53 queries in the engine
+// and relaying them as plain udp flows
+func (t2s *Tun2Socks) SetDnsForwarder(enabled bool) {
+	t2s.dnsEnabled = enabled
+}
+
+// SetFakeIp makes the dns forwarder answer A/AAAA queries with addresses from
+// a reserved pool, so flows toward them carry the domain to the proxy
+func (t2s *Tun2Socks) SetFakeIp(enabled bool) {
+	t2s.fakeIp = enabled
+}
+
+func (t2s *Tun2Socks) SetDnsPolicy(policy *DnsPolicy) {
+	t2s.dnsPolicy = policy
+}
+
+// SetDnsLog records the queries answered by the dns forwarder, nil turns
+// logging off
+func (t2s *Tun2Socks) SetDnsLog(dnsLog *DnsLog) {
+	t2s.dnsLog = dnsLog
+}
+
+func (t2s *Tun2Socks) SetRouter(router *Router) {
+	t2s.router = router
+}
+
 func (t2s *Tun2Socks) SetProxyServers(proxyServerMap map[int]*ProxyServer) {
 	t2s.proxyServerMap = proxyServerMap
 }
@@ -169,6 +403,7 @@ func (t2s *Tun2Socks) SetProxyServers(proxyServerMap map[int]*ProxyServer) {
 func (t2s *Tun2Socks) Stop() {
 	t2s.dev.Close()
 	t2s.stopped = true
+	t2s.SetDnsUrl("", nil)
 
 	t2s.tcpConnTrackLock.Lock()
 	defer t2s.tcpConnTrackLock.Unlock()
@@ -187,6 +422,13 @@ func (t2s *Tun2Socks) Stop() {
 		close(udpTrack.quitByOther)
 	}
 	t2s.udpConnTrackMap = make(map[string]*udpConnTrack)
+
+	t2s.icmpEchoTrackLock.Lock()
+	defer t2s.icmpEchoTrackLock.Unlock()
+	for _, icmpTrack := range t2s.icmpEchoTrackMap {
+		close(icmpTrack.quitByOther)
+	}
+	t2s.icmpEchoTrackMap = make(map[string]*icmpEchoTrack)
 }
 
 func (t2s *Tun2Socks) Run() {
@@ -199,7 +441,7 @@ func (t2s *Tun2Socks) Run() {
 		t2s.wg.Add(1)
 		defer t2s.wg.Done()
 
-		buf := make([]byte, 2*MTU)
+		buf := make([]byte, 2*t2s.mtu)
 		for {
 			if t2s.stopped {
 				//log.Printf("Quit writer in loop")
@@ -236,7 +478,7 @@ func (t2s *Tun2Socks) Run() {
 	}()
 
 	// reader
-	var buf [MTU]byte
+	buf := make([]byte, t2s.mtu)
 	var ip packet.Ip
 	var tcp packet.TCP
 	var udp packet.UDP
@@ -300,15 +542,19 @@ func (t2s *Tun2Socks) Run() {
 			continue
 		}
 
-		if ip.Version == 4 {
-			if ip.V4.Flags&0x1 != 0 || ip.V4.FragOffset != 0 {
-				last, pkt, raw := procFragment(&ip, data)
-				if last {
-					ip = *pkt
-					data = raw
-				} else {
-					continue
-				}
+		if (ip.Version == 4 && (ip.V4.Flags&0x1 != 0 || ip.V4.FragOffset != 0)) || (ip.Version == 6 && ip.V6.Fragment != nil) {
+			if ip.Version == 4 {
+				data = t2s.reassembler.addIPv4(&ip, data)
+			} else {
+				data = t2s.reassembler.addIPv6(&ip, data)
+			}
+			if data == nil {
+				continue
+			}
+			e = packet.ParseIp(data, &ip)
+			if e != nil {
+				log.Printf("error to parse reassembled Ip: %s", e)
+				continue
 			}
 		}
 
@@ -329,6 +575,9 @@ func (t2s *Tun2Socks) Run() {
 			}
 			//	log.Printf("UDP received from tun: %v", udp.DstPort)
 			t2s.udp(data, &ip, &udp)
+
+		case packet.IPProtocolICMPv4, packet.IPProtocolICMPv6:
+			t2s.icmp(&ip)
 		default:
 			//log.Printf("Unsupported proto for ip v%d : %d", ip.Version, ip.GetNextProto())
 			// Unsupported packets
@@ -0,0 +1,40 @@
+package tun2socks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+// fakeTun is a tun device that never yields packets, tests feed the engine
+// directly and read what it writes from writeCh
+type fakeTun struct{}
+
+func (fakeTun) Read(b []byte) (int, error)  { select {} }
+func (fakeTun) Write(b []byte) (int, error) { return len(b), nil }
+func (fakeTun) Close() error                { return nil }
+
+func newTestEngine() *Tun2Socks {
+	return New(fakeTun{}, MTU, nil, nil, 53)
+}
+
+// nextWrite returns the next packet the engine writes to the tun, nil after
+// wait
+func nextWrite(t2s *Tun2Socks, wait time.Duration) interface{} {
+	select {
+	case pkt := <-t2s.writeCh:
+		return pkt
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// parseWire parses a packet the engine built for the tun
+func parseWire(t *testing.T, wire []byte) *packet.Ip {
+	ip := &packet.Ip{}
+	if e := packet.ParseIp(wire, ip); e != nil {
+		t.Fatalf("parse ip: %s", e)
+	}
+	return ip
+}
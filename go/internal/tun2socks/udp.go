@@ -11,7 +11,6 @@ import (
 	"github.com/dkwiebe/gotun2socks/internal/gosocks"
 	"github.com/dkwiebe/gotun2socks/internal/packet"
 	"github.com/getsentry/sentry-go"
-	"github.com/miekg/dns"
 )
 
 type udpPacket struct {
@@ -38,6 +37,8 @@ type udpConnTrack struct {
 	remoteIP   net.IP
 	localPort  uint16
 	remotePort uint16
+	uid        int
+	hostname   string
 
 	destroyed bool
 }
@@ -97,14 +98,15 @@ func copyUDPPacket(raw []byte, ip *packet.Ip, udp *packet.UDP) *udpPacket {
 	return pkt
 }
 
-func responsePacket(local net.IP, remote net.IP, lPort uint16, rPort uint16, respPayload []byte) (*udpPacket, []*ipPacket) {
-	ipid := packet.IPID()
+// responsePacket builds the datagram from remote to local. A datagram larger
+// than mtu comes back as fragments only, the packet is nil then.
+func responsePacket(local net.IP, remote net.IP, lPort uint16, rPort uint16, respPayload []byte, mtu int) (*udpPacket, []*ipPacket) {
 	udp := packet.NewUDP()
 
 	var ip *packet.Ip
 	if remote.To4() != nil {
 		ip = packet.NewIP4()
-		ip.V4.Id = ipid
+		ip.V4.Id = packet.IPID()
 	} else {
 		ip = packet.NewIP6()
 	}
@@ -121,58 +123,52 @@ func responsePacket(local net.IP, remote net.IP, lPort uint16, rPort uint16, res
 	udp.DstPort = lPort
 	udp.Payload = respPayload
 
+	udpHL := 8
+	payloadL := len(udp.Payload)
+	pseudoL := packet.IP4_PSEUDO_LENGTH
+	if ip.Version == 6 {
+		pseudoL = packet.IP6_PSEUDO_LENGTH
+	}
+
+	if ip.HeaderLength()+udpHL+payloadL > mtu {
+		// checksum covers the whole datagram, computed before splitting
+		segment := make([]byte, pseudoL+udpHL+payloadL)
+		ip.PseudoHeader(segment[:pseudoL], packet.IPProtocolUDP, udpHL+payloadL)
+		copy(segment[pseudoL+udpHL:], udp.Payload)
+		udp.Serialize(segment[pseudoL:pseudoL+udpHL], segment[:pseudoL], segment[pseudoL:])
+		frags := genFragments(ip, segment[pseudoL:], mtu)
+		packet.ReleaseUDP(udp)
+		packet.ReleaseIP(ip)
+		return nil, frags
+	}
+
 	pkt := newUDPPacket()
 	pkt.ip = ip
 	pkt.udp = udp
 
 	pkt.mtuBuf = newBuffer()
-	payloadL := len(udp.Payload)
 	payloadStart := MTU - payloadL
-	// if payload too long, need fragment, only part of payload put to mtubuf[28:]
-	if payloadL > MTU-28 {
-		if ip.Version == 4 {
-			ip.V4.Flags = 1
-		}
-		payloadStart = 28
-	}
-	udpHL := 8
 	udpStart := payloadStart - udpHL
-	pseduoStart := udpStart - packet.IP4_PSEUDO_LENGTH
-	if ip.Version == 6 {
-		pseduoStart = udpStart - packet.IP6_PSEUDO_LENGTH
-	}
+	pseduoStart := udpStart - pseudoL
 	ip.PseudoHeader(pkt.mtuBuf[pseduoStart:udpStart], packet.IPProtocolUDP, udpHL+payloadL)
-	// udp length and checksum count on full payload
-	udp.Serialize(pkt.mtuBuf[udpStart:payloadStart], pkt.mtuBuf[pseduoStart:payloadStart], udp.Payload)
 	if payloadL != 0 {
 		copy(pkt.mtuBuf[payloadStart:], udp.Payload)
 	}
+	udp.Serialize(pkt.mtuBuf[udpStart:payloadStart], pkt.mtuBuf[pseduoStart:payloadStart], pkt.mtuBuf[payloadStart:])
 	ipHL := ip.HeaderLength()
 	ipStart := udpStart - ipHL
-	// ip length and checksum count on actual transmitting payload
-	ip.Serialize(pkt.mtuBuf[ipStart:udpStart], udpHL+(MTU-payloadStart))
+	ip.Serialize(pkt.mtuBuf[ipStart:udpStart], udpHL+payloadL)
 	pkt.wire = pkt.mtuBuf[ipStart:]
-
-	if ip.Version == 4 {
-		if ip.V4.Flags == 0 {
-			return pkt, nil
-		}
-	} else {
-		return pkt, nil
-	}
-
-	// generate fragments
-	frags := genFragments(ip, (MTU-20)/8, respPayload[MTU-28:])
-	return pkt, frags
+	return pkt, nil
 }
 
 func (ut *udpConnTrack) send(data []byte) {
-	pkt, fragments := responsePacket(ut.localIP, ut.remoteIP, ut.localPort, ut.remotePort, data)
-	ut.toTunCh <- pkt
-	if fragments != nil {
-		for _, frag := range fragments {
-			ut.toTunCh <- frag
-		}
+	pkt, fragments := responsePacket(ut.localIP, ut.remoteIP, ut.localPort, ut.remotePort, data, ut.t2s.mtu)
+	if pkt != nil {
+		ut.toTunCh <- pkt
+	}
+	for _, frag := range fragments {
+		ut.toTunCh <- frag
 	}
 }
 
@@ -187,6 +183,31 @@ func dialUdpTransparent(address string) (conn *gosocks.SocksConn, err error) {
 	return
 }
 
+// abort tears down a track that never started relaying
+func (ut *udpConnTrack) abort() {
+	if ut.socksConn != nil {
+		ut.socksConn.Close()
+	}
+	close(ut.socksClosed)
+	close(ut.quitBySelf)
+	ut.t2s.clearUDPConnTrack(ut.id)
+}
+
+// reject tears down a track whose flow is refused, answering the packet that
+// opened it with ICMP unreachable unless the reject action is REJECT_RESET.
+// The reader queues that packet right after creating the track.
+func (ut *udpConnTrack) reject() {
+	if action := ut.t2s.rejectAction; action != REJECT_RESET {
+		select {
+		case pkt := <-ut.fromTunCh:
+			ut.toTunCh <- unreachable(pkt.ip, pkt.wire, action)
+			releaseUDPPacket(pkt)
+		case <-ut.quitByOther:
+		}
+	}
+	ut.abort()
+}
+
 func (ut *udpConnTrack) run() {
 	defer sentry.Recover()
 	// connect to socks
@@ -195,28 +216,46 @@ func (ut *udpConnTrack) run() {
 	targetIp := ut.remoteIP
 	port := ut.remotePort
 
-	isQuic := port == 80 || port == 443
-	if isQuic {
-		//log.Print("QUIC blocked")
-		if ut.socksConn != nil {
-			ut.socksConn.Close()
-		}
-		close(ut.socksClosed)
-		close(ut.quitBySelf)
-		ut.t2s.clearUDPConnTrack(ut.id)
+	ut.uid = ut.t2s.FindAppUid(ut.localIP.String(), ut.localPort, ut.remoteIP.String(), ut.remotePort)
+	ut.hostname, _ = ut.t2s.fakeIpHostname(ut.remoteIP)
+	action, proxyServer := ut.t2s.route(&RouteRequest{
+		Uid:      ut.uid,
+		Hostname: ut.t2s.lookupHostname(ut.remoteIP),
+		DstIP:    ut.remoteIP,
+		DstPort:  ut.remotePort,
+		Protocol: packet.IPProtocolUDP,
+	})
+	if action == ROUTE_REJECT {
+		//log.Print("UDP rejected")
+		ut.reject()
 		return
 	}
 
+	customDns := false
 	if port == 53 {
 		if ut.t2s.customDnsHost4 != nil && (targetIp.To4() != nil || ut.t2s.customDnsHost6 == nil) { //use v4 host if v6 is not set
 			port = ut.t2s.customDnsPort
 			targetIp = ut.t2s.customDnsHost4
+			customDns = true
 		} else if ut.t2s.customDnsHost6 != nil && targetIp.To4() == nil {
 			targetIp = ut.t2s.customDnsHost6
 			port = ut.t2s.customDnsPort
+			customDns = true
 		}
 	}
 
+	if !customDns && action == ROUTE_PROXY && proxyServer.ProxyType == PROXY_TYPE_SOCKS {
+		ut.runSocksAssociate(proxyServer)
+		return
+	}
+
+	targetIp, e = ut.t2s.realIp(targetIp)
+	if e != nil {
+		log.Printf("fail to resolve fake ip: %s", e)
+		ut.reject()
+		return
+	}
+
 	var remoteIpPort = ""
 	if targetIp.To4() != nil {
 		remoteIpPort = fmt.Sprintf("%s:%d", targetIp.String(), port)
@@ -230,9 +269,7 @@ func (ut *udpConnTrack) run() {
 	}
 
 	if ut.socksConn == nil {
-		close(ut.socksClosed)
-		close(ut.quitBySelf)
-		ut.t2s.clearUDPConnTrack(ut.id)
+		ut.reject()
 		return
 	}
 
@@ -246,18 +283,73 @@ func (ut *udpConnTrack) run() {
 
 	if err != nil {
 		log.Printf("error in binding local UDP: %s", err)
-		ut.socksConn.Close()
-		close(ut.socksClosed)
-		close(ut.quitBySelf)
-		ut.t2s.clearUDPConnTrack(ut.id)
+		ut.abort()
 		return
 	}
 
 	relayAddr := gosocks.SocksAddrToNetAddr("udp", targetIp.String(), port).(*net.UDPAddr)
 
 	ut.socksConn.SetDeadline(time.Time{})
+	ut.relay(udpBind, relayAddr, nil, nil)
+}
+
+// runSocksAssociate relays the flow through a socks5 UDP association, the
+// association ends together with its control connection
+func (ut *udpConnTrack) runSocksAssociate(proxyServer *ProxyServer) {
+	var e error
+	ut.socksConn, e = dialLocalSocks(proxyServer)
+	if e != nil {
+		log.Printf("fail to connect socks proxy: %s", e)
+		ut.socksConn = nil
+		ut.reject()
+		return
+	}
+
+	relayAddr, e := gosocks.ClientUDPAssociate(ut.socksConn)
+	if e != nil {
+		log.Printf("fail to associate UDP: %s", e)
+		ut.reject()
+		return
+	}
+
+	udpBind, e := net.ListenUDP("udp", nil)
+	if e != nil {
+		log.Printf("error in binding local UDP: %s", e)
+		ut.abort()
+		return
+	}
+
+	hostType, dstHost := socksHost(ut.remoteIP, ut.hostname)
+
 	// monitor socks TCP connection
-	//go gosocks.ConnMonitor(ut.socksConn, ut.socksClosed)
+	go gosocks.ConnMonitor(ut.socksConn, ut.socksClosed)
+
+	encode := func(data []byte) []byte {
+		return gosocks.PackUDPRequest(&gosocks.UDPRequest{
+			Frag:     gosocks.SocksNoFragment,
+			HostType: hostType,
+			DstHost:  dstHost,
+			DstPort:  ut.remotePort,
+			Data:     data,
+		})
+	}
+	decode := func(data []byte) []byte {
+		udpReq, err := gosocks.ParseUDPRequest(data)
+		if err != nil {
+			log.Printf("error to parse UDP packet from relay: %s", err)
+			return nil
+		}
+		if udpReq.Frag != gosocks.SocksNoFragment {
+			return nil
+		}
+		return udpReq.Data
+	}
+	ut.relay(udpBind, relayAddr, encode, decode)
+}
+
+// relay pumps datagrams between the tun and udpBind until either side quits.
+// encode and decode wrap payloads for the relay, nil means as is.
+func (ut *udpConnTrack) relay(udpBind *net.UDPConn, relayAddr *net.UDPAddr, encode func([]byte) []byte, decode func([]byte) []byte) {
 	// read UDP packets from relay
 	quitUDP := make(chan bool)
 	chRelayUDP := make(chan *gosocks.UDPPacket)
@@ -285,10 +377,24 @@ func (ut *udpConnTrack) run() {
 				return
 			}
 			//log.Printf("Reading UDP packet, %v", pkt.Addr.Port)
-			ut.send(pkt.Data)
+			data := pkt.Data
+			if decode != nil {
+				data = decode(data)
+				if data == nil {
+					continue
+				}
+			}
+			if ut.remotePort == 53 {
+				ut.t2s.hostMap.learnPacked(data)
+			}
+			ut.send(data)
 		case pkt := <-ut.fromTunCh:
 			//	log.Printf("Writing UDP packet, %v", pkt.udp.DstPort)
-			_, err := udpBind.WriteToUDP(pkt.udp.Payload, relayAddr)
+			data := pkt.udp.Payload
+			if encode != nil {
+				data = encode(data)
+			}
+			_, err := udpBind.WriteToUDP(data, relayAddr)
 			releaseUDPPacket(pkt)
 			if err != nil {
 				log.Printf("error to send UDP packet to relay: %s", err)
@@ -302,17 +408,6 @@ func (ut *udpConnTrack) run() {
 	}
 }
 
-func dumpDnsResponse(payload []byte) {
-	resp := new(dns.Msg)
-	e := resp.Unpack(payload)
-	if e != nil {
-		log.Printf("Error parsing dns1 %s", e)
-		return
-	}
-	log.Printf("DNS dump:")
-	log.Printf(resp.String())
-}
-
 func (ut *udpConnTrack) newPacket(pkt *udpPacket) {
 	select {
 	case <-ut.quitByOther:
@@ -369,6 +464,21 @@ func (t2s *Tun2Socks) getUDPConnTrack(id string, ip *packet.Ip, udp *packet.UDP)
 }
 
 func (t2s *Tun2Socks) udp(raw []byte, ip *packet.Ip, udp *packet.UDP) {
+	if udp.DstPort == 53 && t2s.dnsEnabled {
+		t2s.dnsServer.handleUdp(raw, ip, udp)
+		return
+	}
+	if t2s.dnsBypass(ip.Dst, udp.DstPort, "") {
+		// the app has to fail fast to fall back, so udp has no silent drop
+		// here, the icmp code follows SetRejectAction
+		action := t2s.rejectAction
+		if action == REJECT_RESET {
+			action = REJECT_ICMP_ADMIN
+		}
+		t2s.writeCh <- unreachable(ip, raw, action)
+		return
+	}
+
 	connID := udpConnID(ip, udp)
 	pkt := copyUDPPacket(raw, ip, udp)
 	track := t2s.getUDPConnTrack(connID, ip, udp)
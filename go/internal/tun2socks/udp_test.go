@@ -0,0 +1,171 @@
+package tun2socks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dkwiebe/gotun2socks/internal/gosocks"
+	"github.com/dkwiebe/gotun2socks/internal/packet"
+)
+
+// serveSocks accepts socks5 requests, as the engine's dialer sends them
+// without a method negotiation, and hands them to gosocks' handler
+func serveSocks(ln net.Listener) {
+	for {
+		c, e := ln.Accept()
+		if e != nil {
+			return
+		}
+		go func(c net.Conn) {
+			conn := &gosocks.SocksConn{Conn: c, Timeout: 5 * time.Second}
+			req, e := gosocks.ReadSocksRequest(conn)
+			if e != nil {
+				conn.Close()
+				return
+			}
+			switch req.Cmd {
+			case gosocks.SocksCmdConnect:
+				(&gosocks.BasicSocksHandler{}).HandleCmdConnect(req, conn)
+			case gosocks.SocksCmdUDPAssociate:
+				(&gosocks.BasicSocksHandler{}).HandleCmdUDPAssociate(req, conn)
+			default:
+				conn.Close()
+			}
+		}(c)
+	}
+}
+
+// clientUDP builds a datagram the app sends from 10.0.0.4 to dst
+func clientUDP(t *testing.T, dst *net.UDPAddr, payload []byte) ([]byte, *packet.Ip, *packet.UDP) {
+	pkt, _ := responsePacket(dst.IP.To4(), net.IPv4(10, 0, 0, 4).To4(), uint16(dst.Port), 40000, payload, MTU)
+	raw := append([]byte(nil), pkt.wire...)
+	releaseUDPPacket(pkt)
+	ip := parseWire(t, raw)
+	udp := &packet.UDP{}
+	if e := packet.ParseUDP(ip.Payload, udp); e != nil {
+		t.Fatalf("parse udp: %s", e)
+	}
+	return raw, ip, udp
+}
+
+func TestUdpDefaultRouteAssociatesThroughSocks(t *testing.T) {
+	echo, e := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer echo.Close()
+	relayed := make(chan *net.UDPAddr, 1)
+	go func() {
+		var buf [1500]byte
+		n, addr, e := echo.ReadFromUDP(buf[:])
+		if e != nil {
+			return
+		}
+		relayed <- addr
+		echo.WriteToUDP(buf[:n], addr)
+	}()
+
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ln.Close()
+	go serveSocks(ln)
+
+	t2s := newTestEngine()
+	t2s.SetDefaultProxy(&ProxyServer{ProxyType: PROXY_TYPE_SOCKS, IpAddress: ln.Addr().String(), Login: "u", Password: "p"})
+
+	dst := localUDPAddr(echo)
+	raw, ip, udp := clientUDP(t, dst, []byte("ping"))
+	t2s.udp(raw, ip, udp)
+
+	select {
+	case <-relayed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("datagram never reached the target through the association")
+	}
+
+	resp, ok := nextWrite(t2s, 5*time.Second).(*udpPacket)
+	if !ok {
+		t.Fatal("no response written to the tun")
+	}
+	if !bytes.Equal(resp.udp.Payload, []byte("ping")) {
+		t.Errorf("response payload %q", resp.udp.Payload)
+	}
+	if resp.udp.SrcPort != uint16(dst.Port) || resp.udp.DstPort != 40000 {
+		t.Errorf("response ports %d -> %d", resp.udp.SrcPort, resp.udp.DstPort)
+	}
+	if !resp.ip.Dst.Equal(net.IPv4(10, 0, 0, 4)) {
+		t.Errorf("response sent to %s", resp.ip.Dst)
+	}
+}
+
+func TestUdpDefaultRoute(t *testing.T) {
+	t2s := newTestEngine()
+	socks := &ProxyServer{ProxyType: PROXY_TYPE_SOCKS}
+	http := &ProxyServer{ProxyType: PROXY_TYPE_HTTP}
+	t2s.SetProxyServers(map[int]*ProxyServer{1: socks, 2: http})
+
+	for _, c := range []struct {
+		uid    int
+		port   uint16
+		action int
+		proxy  *ProxyServer
+	}{
+		{1, 3478, ROUTE_PROXY, socks},
+		{2, 3478, ROUTE_DIRECT, directProxyServer},
+		{3, 3478, ROUTE_DIRECT, directProxyServer},
+		{1, 443, ROUTE_REJECT, directProxyServer},
+	} {
+		action, proxy := t2s.route(&RouteRequest{
+			Uid:      c.uid,
+			DstIP:    net.IPv4(1, 2, 3, 4),
+			DstPort:  c.port,
+			Protocol: packet.IPProtocolUDP,
+		})
+		if action != c.action || proxy != c.proxy {
+			t.Errorf("uid %d port %d: got %d %v", c.uid, c.port, action, proxy)
+		}
+	}
+}
+
+func localUDPAddr(conn *net.UDPConn) *net.UDPAddr {
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestUdpDnsBypassFollowsRejectAction(t *testing.T) {
+	for _, c := range []struct {
+		action int
+		code   uint8
+	}{
+		// -1 keeps the engine's default
+		{-1, packet.ICMPv4CodeAdminProhibited},
+		{REJECT_RESET, packet.ICMPv4CodeAdminProhibited},
+		{REJECT_ICMP_PORT, packet.ICMPv4CodePortUnreachable},
+		{REJECT_ICMP_ADMIN, packet.ICMPv4CodeAdminProhibited},
+	} {
+		t2s := newTestEngine()
+		if c.action >= 0 {
+			t2s.SetRejectAction(c.action)
+		}
+		list := NewDnsBypassList()
+		list.AddIp("192.0.2.53")
+		policy := NewDnsPolicy()
+		policy.SetBypassList(list)
+		t2s.SetDnsPolicy(policy)
+
+		raw, ip, udp := clientUDP(t, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 853}, []byte("doq"))
+		t2s.udp(raw, ip, udp)
+
+		icmp, ok := nextWrite(t2s, 100*time.Millisecond).(*ipPacket)
+		if !ok {
+			t.Fatalf("action %d wrote no icmp", c.action)
+		}
+		reply := parseWire(t, icmp.wire)
+		if reply.Payload[0] != packet.ICMPv4TypeDestUnreachable || reply.Payload[1] != c.code {
+			t.Errorf("action %d: icmp type %d code %d", c.action, reply.Payload[0], reply.Payload[1])
+		}
+	}
+}
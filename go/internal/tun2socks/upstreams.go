@@ -0,0 +1,259 @@
+package tun2socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/miekg/dns"
+)
+
+const (
+	DNS_STRATEGY_FAILOVER    = 0
+	DNS_STRATEGY_RACE        = 1
+	DNS_STRATEGY_ROUND_ROBIN = 2
+
+	// consecutive failures before an upstream is skipped for a while
+	DNS_MAX_FAILURES = 3
+	DNS_DOWN_TIME    = 30 * time.Second
+)
+
+// DnsUpstreamConfig is one server of the upstream list, Url is
+// udp://ip[:port] (or a bare ip[:port]), https://host/path or tls://host[:port].
+// A zero Timeout uses DNS_TIMEOUT.
+type DnsUpstreamConfig struct {
+	Url     string
+	Timeout time.Duration
+}
+
+// newDnsUpstream creates the upstream for a server url, proxy is used for
+// the encrypted ones
+func newDnsUpstream(url string, proxy *ProxyServer) (dnsUpstream, error) {
+	switch {
+	case strings.HasPrefix(url, "https://"):
+		return newDohUpstream(url, proxy), nil
+	case strings.HasPrefix(url, "tls://"):
+		return newDotUpstream(strings.TrimSuffix(strings.TrimPrefix(url, "tls://"), "/"), proxy), nil
+	case strings.Contains(url, "://") && !strings.HasPrefix(url, "udp://"):
+		return nil, fmt.Errorf("Unsupported dns url %s", url)
+	}
+
+	hostPort := strings.TrimSuffix(strings.TrimPrefix(url, "udp://"), "/")
+	host, port, e := net.SplitHostPort(hostPort)
+	if e != nil {
+		host = strings.Trim(hostPort, "[]")
+		port = "53"
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("dns server %s is not an ip address", url)
+	}
+	return newUdpDnsUpstream(net.JoinHostPort(host, port), nil), nil
+}
+
+// CheckDnsUrl reports whether a server url is usable as an upstream
+func CheckDnsUrl(url string) error {
+	upstream, e := newDnsUpstream(url, nil)
+	if e != nil {
+		return e
+	}
+	if closer, ok := upstream.(io.Closer); ok {
+		closer.Close()
+	}
+	return nil
+}
+
+type upstreamMember struct {
+	upstream dnsUpstream
+	timeout  time.Duration
+
+	failures  int
+	downUntil time.Time
+}
+
+type upstreamResult struct {
+	member *upstreamMember
+	resp   *dns.Msg
+	err    error
+}
+
+// dnsUpstreamGroup spreads queries over several upstreams. Upstreams that
+// keep failing are skipped until DNS_DOWN_TIME passes, a SERVFAIL or REFUSED
+// answer falls through to the next upstream.
+type dnsUpstreamGroup struct {
+	strategy int
+
+	lock    sync.Mutex
+	members []*upstreamMember
+	next    int
+}
+
+func newDnsUpstreamGroup(servers []DnsUpstreamConfig, strategy int, proxy *ProxyServer) (*dnsUpstreamGroup, error) {
+	group := &dnsUpstreamGroup{strategy: strategy}
+	for _, server := range servers {
+		upstream, e := newDnsUpstream(server.Url, proxy)
+		if e != nil {
+			group.Close()
+			return nil, e
+		}
+		timeout := server.Timeout
+		if timeout <= 0 {
+			timeout = DNS_TIMEOUT
+		}
+		group.members = append(group.members, &upstreamMember{
+			upstream: upstream,
+			timeout:  timeout,
+		})
+	}
+	if len(group.members) == 0 {
+		return nil, fmt.Errorf("no dns servers")
+	}
+	return group, nil
+}
+
+func (g *dnsUpstreamGroup) String() string {
+	names := make([]string, len(g.members))
+	for i, m := range g.members {
+		names[i] = m.upstream.String()
+	}
+	return strings.Join(names, ",")
+}
+
+func (g *dnsUpstreamGroup) Close() error {
+	for _, m := range g.members {
+		if closer, ok := m.upstream.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return nil
+}
+
+// candidates orders the members for a query by strategy, split into those
+// answering and those marked down
+func (g *dnsUpstreamGroup) candidates() (up []*upstreamMember, down []*upstreamMember) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	start := 0
+	if g.strategy == DNS_STRATEGY_ROUND_ROBIN {
+		start = g.next
+		g.next = (g.next + 1) % len(g.members)
+	}
+
+	now := time.Now()
+	for i := range g.members {
+		m := g.members[(start+i)%len(g.members)]
+		if now.Before(m.downUntil) {
+			down = append(down, m)
+		} else {
+			up = append(up, m)
+		}
+	}
+	return
+}
+
+func (g *dnsUpstreamGroup) report(m *upstreamMember, e error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if e == nil {
+		m.failures = 0
+		m.downUntil = time.Time{}
+		return
+	}
+	m.failures++
+	if m.failures >= DNS_MAX_FAILURES {
+		m.downUntil = time.Now().Add(DNS_DOWN_TIME)
+	}
+}
+
+// exchangeMember queries one upstream within its own timeout
+func (g *dnsUpstreamGroup) exchangeMember(m *upstreamMember, req *dns.Msg) (*dns.Msg, error) {
+	ch := make(chan upstreamResult, 1)
+	go func() {
+		defer sentry.Recover()
+		resp, e := m.upstream.Exchange(req)
+		ch <- upstreamResult{member: m, resp: resp, err: e}
+	}()
+
+	timer := time.NewTimer(m.timeout)
+	defer timer.Stop()
+	var result upstreamResult
+	select {
+	case result = <-ch:
+	case <-timer.C:
+		result.err = fmt.Errorf("timeout waiting for %s", m.upstream)
+	}
+	if result.err == nil && !answered(result.resp) {
+		// the answer is still returned, the next upstream may do better
+		g.report(m, fmt.Errorf("%s answered %s", m.upstream, dns.RcodeToString[result.resp.Rcode]))
+	} else {
+		g.report(m, result.err)
+	}
+	return result.resp, result.err
+}
+
+func answered(resp *dns.Msg) bool {
+	return resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused
+}
+
+func (g *dnsUpstreamGroup) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	up, down := g.candidates()
+	if g.strategy == DNS_STRATEGY_RACE {
+		if len(up) == 0 {
+			up = down
+		}
+		return g.race(up, req)
+	}
+
+	// upstreams marked down are still tried when nothing else answers
+	var lastResp *dns.Msg
+	var lastErr error
+	for _, m := range append(up, down...) {
+		resp, e := g.exchangeMember(m, req)
+		if e != nil {
+			lastErr = e
+			continue
+		}
+		if answered(resp) {
+			return resp, nil
+		}
+		lastResp = resp
+	}
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	return nil, lastErr
+}
+
+// race asks all members at once and returns the first real answer
+func (g *dnsUpstreamGroup) race(members []*upstreamMember, req *dns.Msg) (*dns.Msg, error) {
+	ch := make(chan upstreamResult, len(members))
+	for _, m := range members {
+		go func(m *upstreamMember) {
+			defer sentry.Recover()
+			resp, e := g.exchangeMember(m, req)
+			ch <- upstreamResult{member: m, resp: resp, err: e}
+		}(m)
+	}
+
+	var lastResp *dns.Msg
+	var lastErr error
+	for range members {
+		result := <-ch
+		if result.err != nil {
+			lastErr = result.err
+			continue
+		}
+		if answered(result.resp) {
+			return result.resp, nil
+		}
+		lastResp = result.resp
+	}
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	return nil, lastErr
+}
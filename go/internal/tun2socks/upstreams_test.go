@@ -0,0 +1,41 @@
+package tun2socks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rcodeUpstream answers every query with a fixed rcode
+type rcodeUpstream struct {
+	rcode int
+}
+
+func (u rcodeUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetRcode(req, u.rcode)
+	return resp, nil
+}
+
+func (u rcodeUpstream) String() string {
+	return dns.RcodeToString[u.rcode]
+}
+
+func TestDnsUpstreamGroupSkipsServfail(t *testing.T) {
+	failing := &upstreamMember{upstream: rcodeUpstream{dns.RcodeServerFailure}, timeout: time.Second}
+	working := &upstreamMember{upstream: rcodeUpstream{dns.RcodeSuccess}, timeout: time.Second}
+	group := &dnsUpstreamGroup{strategy: DNS_STRATEGY_FAILOVER, members: []*upstreamMember{failing, working}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < DNS_MAX_FAILURES; i++ {
+		resp, e := group.Exchange(req)
+		if e != nil || resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("exchange %d: %v %v", i, resp, e)
+		}
+	}
+	if up, down := group.candidates(); len(up) != 1 || up[0] != working || len(down) != 1 {
+		t.Errorf("SERVFAIL upstream not marked down: up %d down %d", len(up), len(down))
+	}
+}